@@ -0,0 +1,118 @@
+package avl
+
+import "github.com/jrouviere/minikv/comparator"
+
+// FromSorted builds a perfectly balanced tree in O(n) from next, which
+// returns the key/value pairs in increasing key order according to cmp
+// and false once done. When a key is repeated, the last value wins.
+func FromSorted(cmp comparator.Comparator, next func() (key, value []byte, ok bool)) *Tree {
+	t := New(cmp)
+	nodes := collectSorted(t.comparator(), next)
+	for _, n := range nodes {
+		t.bytes.Add(n.bytes())
+	}
+	t.root.Store(build(nodes))
+	return t
+}
+
+// UpsertSorted applies a batch of updates given in increasing key order,
+// as FromSorted. Large batches are merged with the existing keys and the
+// tree rebuilt in a single pass, small ones are upserted one by one.
+func (t *Tree) UpsertSorted(next func() (key, value []byte, ok bool)) {
+	cmp := t.comparator()
+	updates := collectSorted(cmp, next)
+	if len(updates) == 0 {
+		return
+	}
+
+	for {
+		root := t.root.Load()
+
+		var delta int64
+		for _, n := range updates {
+			delta += n.bytes()
+			if old := find(cmp, root, n.Key); old != nil {
+				delta -= old.bytes()
+			}
+		}
+
+		var newRoot *Node
+		if len(updates)*root.height() < root.count() {
+			newRoot = root
+			for _, n := range updates {
+				newRoot = upsert(cmp, newRoot, leaf(n))
+			}
+		} else {
+			newRoot = build(mergeSorted(cmp, root, updates))
+		}
+
+		if t.root.CompareAndSwap(root, newRoot) {
+			t.bytes.Add(delta)
+			return
+		}
+	}
+}
+
+func collectSorted(cmp comparator.Comparator, next func() (key, value []byte, ok bool)) []*Node {
+	var nodes []*Node
+	for {
+		key, value, ok := next()
+		if !ok {
+			return nodes
+		}
+
+		if len(nodes) > 0 {
+			last := nodes[len(nodes)-1]
+			c := cmp.Compare(key, last.Key)
+			if c < 0 {
+				panic("avl: input is not sorted")
+			}
+			if c == 0 {
+				last.Value = value
+				continue
+			}
+		}
+		nodes = append(nodes, &Node{Key: key, Value: value})
+	}
+}
+
+// mergeSorted returns new nodes for all the keys of the subtree n
+// and the updates, the updates winning over existing keys
+func mergeSorted(cmp comparator.Comparator, n *Node, updates []*Node) []*Node {
+	res := make([]*Node, 0, n.count()+len(updates))
+	inorderTraversal(n, func(n *Node) {
+		for len(updates) > 0 && cmp.Compare(updates[0].Key, n.Key) < 0 {
+			res = append(res, leaf(updates[0]))
+			updates = updates[1:]
+		}
+		if len(updates) > 0 && cmp.Compare(updates[0].Key, n.Key) == 0 {
+			return
+		}
+		res = append(res, leaf(n))
+	})
+	for _, u := range updates {
+		res = append(res, leaf(u))
+	}
+	return res
+}
+
+// leaf returns a new unlinked node with the key and value of n
+func leaf(n *Node) *Node {
+	return &Node{Key: n.Key, Value: n.Value, h: 1, size: 1}
+}
+
+// build links the sorted nodes in a balanced tree, the nodes must
+// not be shared with any other tree
+func build(nodes []*Node) *Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	mid := len(nodes) / 2
+	n := nodes[mid]
+	n.left = build(nodes[:mid])
+	n.right = build(nodes[mid+1:])
+	n.update()
+
+	return n
+}
@@ -0,0 +1,87 @@
+package avl
+
+import (
+	"sort"
+	"testing"
+)
+
+func sortedStream(keys []string) func() ([]byte, []byte, bool) {
+	return func() ([]byte, []byte, bool) {
+		if len(keys) == 0 {
+			return nil, nil, false
+		}
+		k := keys[0]
+		keys = keys[1:]
+		return []byte(k), []byte("value_" + k), true
+	}
+}
+
+func TestFromSorted(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 7, 8, 1000} {
+		var keys []string
+		for i := 0; i < n; i++ {
+			keys = append(keys, randString(4))
+		}
+		sort.Strings(keys)
+
+		tree := FromSorted(nil, sortedStream(keys))
+		checkInvariants(t, tree)
+
+		// duplicates are collapsed
+		var exp int
+		for i := range keys {
+			if i == 0 || keys[i] != keys[i-1] {
+				exp++
+			}
+		}
+		if tree.Len() != exp {
+			t.Errorf("unexpected Len: %v != %v", tree.Len(), exp)
+		}
+		for _, k := range keys {
+			if v, found := tree.Get([]byte(k)); !found || string(v) != "value_"+k {
+				t.Errorf("unexpected value for %v: %v", k, v)
+			}
+		}
+	}
+}
+
+func TestUpsertSorted(t *testing.T) {
+	for _, sz := range []int{1, 10, 1000} {
+		var tree Tree
+		all := make(map[string]string)
+
+		for i := 0; i < 1000; i++ {
+			k := randString(2)
+			tree.Upsert([]byte(k), []byte("old"))
+			all[k] = "old"
+		}
+
+		var keys []string
+		for i := 0; i < sz; i++ {
+			keys = append(keys, randString(2))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			all[k] = "value_" + k
+		}
+
+		snapshot := tree.Iterator()
+		tree.UpsertSorted(sortedStream(keys))
+		checkInvariants(t, &tree)
+
+		if tree.Len() != len(all) {
+			t.Errorf("unexpected Len: %v != %v", tree.Len(), len(all))
+		}
+		for k, exp := range all {
+			if v, _ := tree.Get([]byte(k)); string(v) != exp {
+				t.Errorf("unexpected value for %v: %v != %v", k, v, exp)
+			}
+		}
+
+		for snapshot.First(); snapshot.Valid(); snapshot.Next() {
+			if string(snapshot.Value()) != "old" {
+				t.Fatalf("snapshot was modified by UpsertSorted")
+			}
+		}
+	}
+}
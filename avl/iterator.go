@@ -0,0 +1,133 @@
+package avl
+
+import "github.com/jrouviere/minikv/comparator"
+
+// Iterator walks the tree as it was when the iterator was created,
+// later updates swap the root of the tree and are not visible.
+// It keeps the path from the root to the current node in an explicit
+// stack, so that it can move in both directions.
+type Iterator struct {
+	cmp   comparator.Comparator
+	root  *Node
+	stack []*Node
+}
+
+// Iterator returns an unpositioned iterator over a snapshot of the tree,
+// one of First, Last or Seek must be called before using it.
+func (t *Tree) Iterator() *Iterator {
+	return &Iterator{
+		cmp:  t.comparator(),
+		root: t.root.Load(),
+	}
+}
+
+// Valid returns false when the iterator moved past either end of the tree
+func (it *Iterator) Valid() bool {
+	return len(it.stack) > 0
+}
+
+// Key returns the current key, it must not be modified
+func (it *Iterator) Key() []byte {
+	return it.top().Key
+}
+
+// Value returns the current value, it must not be modified
+func (it *Iterator) Value() []byte {
+	return it.top().Value
+}
+
+func (it *Iterator) top() *Node {
+	return it.stack[len(it.stack)-1]
+}
+
+// First moves to the smallest key
+func (it *Iterator) First() {
+	it.stack = it.stack[:0]
+	it.pushLeft(it.root)
+}
+
+// Last moves to the largest key
+func (it *Iterator) Last() {
+	it.stack = it.stack[:0]
+	it.pushRight(it.root)
+}
+
+// Seek moves to the smallest key greater or equal to key
+func (it *Iterator) Seek(key []byte) {
+	it.stack = it.stack[:0]
+
+	n := it.root
+	for n != nil {
+		it.stack = append(it.stack, n)
+		c := it.cmp.Compare(key, n.Key)
+		if c == 0 {
+			return
+		}
+		if c < 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+
+	// we stopped either on the predecessor or the successor of key
+	if it.Valid() && it.cmp.Compare(it.Key(), key) < 0 {
+		it.Next()
+	}
+}
+
+// Next moves to the next key in order
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+
+	if n := it.top(); n.right != nil {
+		it.pushLeft(n.right)
+		return
+	}
+
+	// climb up until we come from a left child
+	for {
+		child := it.top()
+		it.stack = it.stack[:len(it.stack)-1]
+		if !it.Valid() || it.top().left == child {
+			return
+		}
+	}
+}
+
+// Prev moves to the previous key in order
+func (it *Iterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+
+	if n := it.top(); n.left != nil {
+		it.pushRight(n.left)
+		return
+	}
+
+	// climb up until we come from a right child
+	for {
+		child := it.top()
+		it.stack = it.stack[:len(it.stack)-1]
+		if !it.Valid() || it.top().right == child {
+			return
+		}
+	}
+}
+
+func (it *Iterator) pushLeft(n *Node) {
+	for n != nil {
+		it.stack = append(it.stack, n)
+		n = n.left
+	}
+}
+
+func (it *Iterator) pushRight(n *Node) {
+	for n != nil {
+		it.stack = append(it.stack, n)
+		n = n.right
+	}
+}
@@ -0,0 +1,96 @@
+package avl
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	var tree Tree
+	var all []string
+
+	it := tree.Iterator()
+	it.First()
+	if it.Valid() {
+		t.Errorf("iterator on an empty tree should not be valid")
+	}
+
+	for i := 0; i < 1e3; i++ {
+		rdKey := randString(2)
+		if _, found := tree.Get([]byte(rdKey)); !found {
+			all = append(all, rdKey)
+		}
+		tree.Upsert([]byte(rdKey), []byte("value_"+rdKey))
+	}
+	sort.Strings(all)
+
+	it = tree.Iterator()
+
+	// concurrent updates must not be visible by the iterator
+	tree.Upsert([]byte("new"), []byte("value"))
+	tree.Upsert([]byte(all[0]), []byte("updated"))
+
+	var keys []string
+	for it.First(); it.Valid(); it.Next() {
+		if string(it.Value()) != "value_"+string(it.Key()) {
+			t.Errorf("unexpected value for %v: %v", string(it.Key()), string(it.Value()))
+		}
+		keys = append(keys, string(it.Key()))
+	}
+	checkKeys(t, keys, all)
+
+	keys = keys[:0]
+	for it.Last(); it.Valid(); it.Prev() {
+		keys = append(keys, string(it.Key()))
+	}
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	checkKeys(t, keys, all)
+
+	for i := 0; i < 100; i++ {
+		key := randString(2)
+		exp := sort.SearchStrings(all, key)
+
+		it.Seek([]byte(key))
+		if exp == len(all) {
+			if it.Valid() {
+				t.Errorf("Seek(%v) should be past the end, got %v", key, string(it.Key()))
+			}
+			continue
+		}
+		if !it.Valid() || string(it.Key()) != all[exp] {
+			t.Fatalf("Seek(%v) should be on %v", key, all[exp])
+		}
+
+		// check both directions from there
+		it.Prev()
+		if exp == 0 && it.Valid() {
+			t.Errorf("Prev after Seek(%v) should be past the start, got %v", key, string(it.Key()))
+		}
+		if exp > 0 && (!it.Valid() || string(it.Key()) != all[exp-1]) {
+			t.Errorf("Prev after Seek(%v) should be on %v", key, all[exp-1])
+		}
+
+		it.Seek([]byte(key))
+		it.Next()
+		if exp == len(all)-1 && it.Valid() {
+			t.Errorf("Next after Seek(%v) should be past the end, got %v", key, string(it.Key()))
+		}
+		if exp < len(all)-1 && (!it.Valid() || string(it.Key()) != all[exp+1]) {
+			t.Errorf("Next after Seek(%v) should be on %v", key, all[exp+1])
+		}
+	}
+}
+
+func checkKeys(t *testing.T, keys, exp []string) {
+	t.Helper()
+	if len(keys) != len(exp) {
+		t.Fatalf("got %v keys, expected %v", len(keys), len(exp))
+	}
+	for i := range keys {
+		if keys[i] != exp[i] {
+			t.Errorf("invalid key, got %v, exp %v", keys[i], exp[i])
+		}
+	}
+}
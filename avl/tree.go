@@ -2,17 +2,51 @@ package avl
 
 import (
 	"sync/atomic"
+	"unsafe"
+
+	"github.com/jrouviere/minikv/comparator"
 )
 
+// Tree is a persistent AVL tree: updates never modify existing nodes
+// but swap the root. The zero value is an empty tree ordering keys with
+// comparator.Bytewise.
 type Tree struct {
-	root atomic.Pointer[Node]
+	root  atomic.Pointer[Node]
+	bytes atomic.Int64
+	cmp   comparator.Comparator
+}
+
+// New returns an empty tree ordering keys with cmp,
+// nil means comparator.Bytewise
+func New(cmp comparator.Comparator) *Tree {
+	return &Tree{cmp: cmp}
+}
+
+// Snapshot returns a copy of the tree in O(1): both trees share their
+// nodes, and later updates of either of them are not visible in the other.
+func (t *Tree) Snapshot() *Tree {
+	s := &Tree{cmp: t.cmp}
+	s.root.Store(t.root.Load())
+	s.bytes.Store(t.bytes.Load())
+	return s
 }
 
+func (t *Tree) comparator() comparator.Comparator {
+	if t.cmp == nil {
+		return comparator.Bytewise
+	}
+	return t.cmp
+}
+
+// nodeOverhead is the memory used by a node besides its key and value
+const nodeOverhead = int64(unsafe.Sizeof(Node{}))
+
 type Node struct {
 	left, right *Node
 	h           int
-	Key         string
-	Value       string
+	size        int // number of nodes in the subtree
+	Key         []byte
+	Value       []byte
 }
 
 func (n *Node) height() int {
@@ -22,98 +56,350 @@ func (n *Node) height() int {
 	return n.h
 }
 
-func (n *Node) updateH() {
+// bytes returns the memory used by the node, excluding its children
+func (n *Node) bytes() int64 {
+	return nodeOverhead + int64(len(n.Key)+len(n.Value))
+}
+
+func (n *Node) count() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// update recomputes height and size from the children
+func (n *Node) update() {
 	n.h = max(n.left.height(), n.right.height()) + 1
+	n.size = n.left.count() + n.right.count() + 1
 }
 
 func (n *Node) balance() int {
 	return n.right.height() - n.left.height()
 }
 
-func (t *Tree) Get(key string) (string, bool) {
+func (t *Tree) Empty() bool {
+	return t.root.Load() == nil
+}
+
+// Len returns the number of keys in the tree
+func (t *Tree) Len() int {
+	return t.root.Load().count()
+}
+
+// Rank returns the number of keys strictly lower than key
+func (t *Tree) Rank(key []byte) int {
+	cmp := t.comparator()
+	var rank int
+	n := t.root.Load()
+	for n != nil {
+		if c := cmp.Compare(key, n.Key); c <= 0 {
+			if c == 0 {
+				return rank + n.left.count()
+			}
+			n = n.left
+		} else {
+			rank += n.left.count() + 1
+			n = n.right
+		}
+	}
+	return rank
+}
+
+// Select returns the node with the i-th smallest key, starting at 0,
+// or nil if i is out of range
+func (t *Tree) Select(i int) *Node {
 	n := t.root.Load()
 	for n != nil {
-		if key == n.Key {
-			return n.Value, true
+		left := n.left.count()
+		switch {
+		case i < left:
+			n = n.left
+		case i == left:
+			return n
+		default:
+			i -= left + 1
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// ApproximateSize returns the memory used by the keys, values and nodes
+// of the tree in bytes. Nodes replaced by updates but still referenced
+// by snapshots are not accounted for.
+func (t *Tree) ApproximateSize() int64 {
+	return t.bytes.Load()
+}
+
+func (t *Tree) Get(key []byte) ([]byte, bool) {
+	if n := find(t.comparator(), t.root.Load(), key); n != nil {
+		return n.Value, true
+	}
+	return nil, false
+}
+
+func find(cmp comparator.Comparator, n *Node, key []byte) *Node {
+	for n != nil {
+		c := cmp.Compare(key, n.Key)
+		if c == 0 {
+			return n
 		}
-		if key < n.Key {
+		if c < 0 {
 			n = n.left
 		} else {
 			n = n.right
 		}
 	}
-	return "", false
+	return nil
 }
 
-func (t *Tree) Upsert(key, value string) {
+// Upsert inserts or updates key, the tree keeps references to
+// key and value: they must not be modified afterwards.
+func (t *Tree) Upsert(key, value []byte) {
 	node := &Node{
 		Key:   key,
 		Value: value,
 		h:     1,
+		size:  1,
 	}
 
-	var changed bool
-	for !changed {
+	cmp := t.comparator()
+	for {
 		root := t.root.Load()
 
-		changed = t.root.CompareAndSwap(root, upsert(root, node))
+		delta := node.bytes()
+		if old := find(cmp, root, key); old != nil {
+			delta -= old.bytes()
+		}
+
+		if t.root.CompareAndSwap(root, upsert(cmp, root, node)) {
+			t.bytes.Add(delta)
+			return
+		}
 	}
 }
 
-func upsert(cur *Node, node *Node) *Node {
+func upsert(cmp comparator.Comparator, cur *Node, node *Node) *Node {
 	if cur == nil {
 		return node
 	}
-	if node.Key == cur.Key { // update
+	c := cmp.Compare(node.Key, cur.Key)
+	if c == 0 { // update
 		return &Node{
 			Key:   cur.Key,
 			Value: node.Value,
 			h:     cur.h,
+			size:  cur.size,
 			left:  cur.left,
 			right: cur.right,
 		}
 	}
 
-	if node.Key < cur.Key {
-		res := &Node{
+	var res *Node
+	if c < 0 {
+		res = &Node{
 			Key:   cur.Key,
 			Value: cur.Value,
-			left:  upsert(cur.left, node),
+			left:  upsert(cmp, cur.left, node),
 			right: cur.right,
 		}
-		res.updateH()
+	} else {
+		res = &Node{
+			Key:   cur.Key,
+			Value: cur.Value,
+			left:  cur.left,
+			right: upsert(cmp, cur.right, node),
+		}
+	}
+	res.update()
 
-		if res.balance() < -1 {
-			if res.left.balance() <= 0 {
-				// left-left
-				return rotateRight(res)
-			} else {
-				// left-right
-				return rotateLeftRight(res)
-			}
+	return rebalance(res)
+}
+
+// Delete removes key from the tree, it returns false if the key was not found
+func (t *Tree) Delete(key []byte) bool {
+	cmp := t.comparator()
+	for {
+		root := t.root.Load()
+
+		old := find(cmp, root, key)
+		if old == nil {
+			return false
+		}
+		newRoot, _ := remove(cmp, root, key)
+		if t.root.CompareAndSwap(root, newRoot) {
+			t.bytes.Add(-old.bytes())
+			return true
 		}
+	}
+}
 
-		return res
-	} else {
-		res := &Node{
+func remove(cmp comparator.Comparator, cur *Node, key []byte) (*Node, bool) {
+	if cur == nil {
+		return nil, false
+	}
+
+	var res *Node
+	switch c := cmp.Compare(key, cur.Key); {
+	case c < 0:
+		left, found := remove(cmp, cur.left, key)
+		if !found {
+			return cur, false
+		}
+		res = &Node{
+			Key:   cur.Key,
+			Value: cur.Value,
+			left:  left,
+			right: cur.right,
+		}
+
+	case c > 0:
+		right, found := remove(cmp, cur.right, key)
+		if !found {
+			return cur, false
+		}
+		res = &Node{
 			Key:   cur.Key,
 			Value: cur.Value,
 			left:  cur.left,
-			right: upsert(cur.right, node),
+			right: right,
 		}
-		res.updateH()
 
-		if res.balance() > 1 {
-			if res.right.balance() >= 0 {
-				// right-right
-				return rotateLeft(res)
-			} else {
-				// right-left
-				return rotateRightLeft(res)
-			}
+	default:
+		if cur.left == nil {
+			return cur.right, true
+		}
+		if cur.right == nil {
+			return cur.left, true
+		}
+
+		// replace by the in-order successor
+		succ := minNode(cur.right)
+		right, _ := remove(cmp, cur.right, succ.Key)
+		res = &Node{
+			Key:   succ.Key,
+			Value: succ.Value,
+			left:  cur.left,
+			right: right,
+		}
+	}
+	res.update()
+
+	return rebalance(res), true
+}
+
+func rebalance(n *Node) *Node {
+	if n.balance() < -1 {
+		if n.left.balance() <= 0 {
+			// left-left
+			return rotateRight(n)
+		} else {
+			// left-right
+			return rotateLeftRight(n)
+		}
+	}
+
+	if n.balance() > 1 {
+		if n.right.balance() >= 0 {
+			// right-right
+			return rotateLeft(n)
+		} else {
+			// right-left
+			return rotateRightLeft(n)
+		}
+	}
+
+	return n
+}
+
+// Min returns the node with the smallest key, or nil if the tree is empty
+func (t *Tree) Min() *Node {
+	return minNode(t.root.Load())
+}
+
+// Max returns the node with the largest key, or nil if the tree is empty
+func (t *Tree) Max() *Node {
+	n := t.root.Load()
+	for n != nil && n.right != nil {
+		n = n.right
+	}
+	return n
+}
+
+func minNode(n *Node) *Node {
+	for n != nil && n.left != nil {
+		n = n.left
+	}
+	return n
+}
+
+// Floor returns the node with the largest key lower or equal to key,
+// or nil if there is none
+func (t *Tree) Floor(key []byte) *Node {
+	cmp := t.comparator()
+	var res *Node
+	n := t.root.Load()
+	for n != nil {
+		c := cmp.Compare(key, n.Key)
+		if c == 0 {
+			return n
+		}
+		if c < 0 {
+			n = n.left
+		} else {
+			res = n
+			n = n.right
+		}
+	}
+	return res
+}
+
+// Ceiling returns the node with the smallest key greater or equal to key,
+// or nil if there is none
+func (t *Tree) Ceiling(key []byte) *Node {
+	cmp := t.comparator()
+	var res *Node
+	n := t.root.Load()
+	for n != nil {
+		c := cmp.Compare(key, n.Key)
+		if c == 0 {
+			return n
+		}
+		if c < 0 {
+			res = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return res
+}
+
+// Range calls f in order for each key in [from, to), an empty to
+// means no upper bound. The walk stops as soon as f returns false.
+func (t *Tree) Range(from, to []byte, f func(n *Node) bool) {
+	rangeTraversal(t.comparator(), t.root.Load(), from, to, f)
+}
+
+func rangeTraversal(cmp comparator.Comparator, n *Node, from, to []byte, f func(n *Node) bool) bool {
+	if n == nil {
+		return true
+	}
+	if cmp.Compare(from, n.Key) < 0 {
+		if !rangeTraversal(cmp, n.left, from, to, f) {
+			return false
+		}
+	}
+	if len(to) > 0 && cmp.Compare(n.Key, to) >= 0 {
+		return false
+	}
+	if cmp.Compare(n.Key, from) >= 0 {
+		if !f(n) {
+			return false
 		}
-		return res
 	}
+	return rangeTraversal(cmp, n.right, from, to, f)
 }
 
 func (t *Tree) InorderTraversal(f func(n *Node)) {
@@ -130,43 +416,57 @@ func inorderTraversal(n *Node, f func(n *Node)) {
 	inorderTraversal(n.right, f)
 }
 
+// Rotations never modify their input: the nodes they move are copied,
+// so that concurrent readers of older roots, or a losing CAS attempt,
+// still see an intact tree.
+
 func rotateLeft(root *Node) *Node {
-	return _rotateLeft(root)
+	pivot := root.right
+
+	left := root.clone()
+	left.right = pivot.left
+	left.update()
+
+	res := pivot.clone()
+	res.left = left
+	res.update()
+
+	return res
 }
 
 func rotateRight(root *Node) *Node {
-	return _rotateRight(root)
-}
+	pivot := root.left
 
-func rotateLeftRight(root *Node) *Node {
-	root.left = _rotateLeft(root.left)
-	return _rotateRight(root)
-}
-func rotateRightLeft(root *Node) *Node {
-	root.right = _rotateRight(root.right)
-	return _rotateLeft(root)
-}
+	right := root.clone()
+	right.left = pivot.right
+	right.update()
 
-func _rotateLeft(root *Node) *Node {
-	pivot := root.right
-	root.right = pivot.left
-	pivot.left = root
+	res := pivot.clone()
+	res.right = right
+	res.update()
 
-	root.updateH()
-	pivot.updateH()
+	return res
+}
 
-	return pivot
+func rotateLeftRight(root *Node) *Node {
+	res := root.clone()
+	res.left = rotateLeft(root.left)
+	res.update()
+
+	return rotateRight(res)
 }
 
-func _rotateRight(root *Node) *Node {
-	pivot := root.left
-	root.left = pivot.right
-	pivot.right = root
+func rotateRightLeft(root *Node) *Node {
+	res := root.clone()
+	res.right = rotateRight(root.right)
+	res.update()
 
-	root.updateH()
-	pivot.updateH()
+	return rotateLeft(res)
+}
 
-	return pivot
+func (n *Node) clone() *Node {
+	c := *n
+	return &c
 }
 
 func max(a, b int) int {
@@ -1,18 +1,23 @@
 package avl
 
 import (
+	"bytes"
+	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 )
 
 func TestTreeGet(t *testing.T) {
 	var tree Tree
 
-	tree.Upsert("a", "value_a")
-	tree.Upsert("b", "value_b")
-	tree.Upsert("c", "value_c")
-	tree.Upsert("d", "value_d")
-	tree.Upsert("e", "value_e")
+	tree.Upsert([]byte("a"), []byte("value_a"))
+	tree.Upsert([]byte("b"), []byte("value_b"))
+	tree.Upsert([]byte("c"), []byte("value_c"))
+	tree.Upsert([]byte("d"), []byte("value_d"))
+	tree.Upsert([]byte("e"), []byte("value_e"))
 
 	testCases := []struct {
 		key string
@@ -27,11 +32,11 @@ func TestTreeGet(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		val, ok := tree.Get(tc.key)
+		val, ok := tree.Get([]byte(tc.key))
 		if ok != tc.ok {
 			t.Errorf("invalid ok for %v, expected %v but got %v", tc.key, tc.ok, ok)
 		}
-		if val != tc.val {
+		if string(val) != tc.val {
 			t.Errorf("invalid val for %v, expected %v but got %v", tc.key, tc.val, val)
 		}
 	}
@@ -50,7 +55,7 @@ func TestTreeUpsertBase(t *testing.T) {
 	} {
 		var tree Tree
 		for _, k := range tc {
-			tree.Upsert(k, "value-"+k)
+			tree.Upsert([]byte(k), []byte("value-"+k))
 		}
 		root := tree.root.Load()
 		h := computeHeight(root)
@@ -71,21 +76,21 @@ func TestTreeUpsertBase(t *testing.T) {
 func TestTreeUpsert1(t *testing.T) {
 	var tree Tree
 
-	tree.Upsert("f", "value_f")
-	tree.Upsert("b", "value_b")
-	tree.Upsert("c", "value_c")
-	tree.Upsert("d", "value_d")
-	tree.Upsert("a", "value_a")
-	tree.Upsert("h", "value_h")
-	tree.Upsert("e", "value_e")
-	tree.Upsert("f", "value_f2")
-	tree.Upsert("g", "value_g")
+	tree.Upsert([]byte("f"), []byte("value_f"))
+	tree.Upsert([]byte("b"), []byte("value_b"))
+	tree.Upsert([]byte("c"), []byte("value_c"))
+	tree.Upsert([]byte("d"), []byte("value_d"))
+	tree.Upsert([]byte("a"), []byte("value_a"))
+	tree.Upsert([]byte("h"), []byte("value_h"))
+	tree.Upsert([]byte("e"), []byte("value_e"))
+	tree.Upsert([]byte("f"), []byte("value_f2"))
+	tree.Upsert([]byte("g"), []byte("value_g"))
 
 	checkInvariants(t, &tree)
 
 	var keys []string
 	tree.InorderTraversal(func(n *Node) {
-		keys = append(keys, n.Key)
+		keys = append(keys, string(n.Key))
 	})
 	exp := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
 	for i := range keys {
@@ -103,21 +108,190 @@ func TestRandomUpsert(t *testing.T) {
 		rdKey := randString(3)
 		rdVal := randString(8)
 
-		tree.Upsert(rdKey, rdVal)
+		tree.Upsert([]byte(rdKey), []byte(rdVal))
 	}
 	checkInvariants(t, &tree)
 
 	for expK, expV := range all {
-		val, f := tree.Get(expK)
+		val, f := tree.Get([]byte(expK))
 		if !f {
 			t.Errorf("Get didn't find key: %v", expK)
 		}
-		if expV != val {
+		if expV != string(val) {
 			t.Errorf("Get didn't return expected value: %v != %v", expV, val)
 		}
 	}
 }
 
+func TestTreeDelete(t *testing.T) {
+	var tree Tree
+	all := make(map[string]string)
+
+	for i := 0; i < 1e4; i++ {
+		rdKey := randString(2)
+		rdVal := randString(8)
+
+		tree.Upsert([]byte(rdKey), []byte(rdVal))
+		all[rdKey] = rdVal
+	}
+
+	for i := 0; i < 1e4; i++ {
+		rdKey := randString(2)
+		_, exp := all[rdKey]
+		if found := tree.Delete([]byte(rdKey)); found != exp {
+			t.Errorf("Delete(%v) returned %v, expected %v", rdKey, found, exp)
+		}
+		delete(all, rdKey)
+	}
+	checkInvariants(t, &tree)
+
+	var count int
+	tree.InorderTraversal(func(n *Node) {
+		count++
+		if all[string(n.Key)] != string(n.Value) {
+			t.Errorf("unexpected value for %v: %v != %v", string(n.Key), string(n.Value), all[string(n.Key)])
+		}
+	})
+	if count != len(all) {
+		t.Errorf("unexpected key count: %v != %v", count, len(all))
+	}
+
+	for k := range all {
+		tree.Delete([]byte(k))
+	}
+	if !tree.Empty() {
+		t.Errorf("tree should be empty")
+	}
+}
+
+func TestTreeBounds(t *testing.T) {
+	var tree Tree
+
+	if tree.Min() != nil || tree.Max() != nil || tree.Floor([]byte("a")) != nil || tree.Ceiling([]byte("a")) != nil {
+		t.Errorf("empty tree should have no bounds")
+	}
+
+	for _, k := range []string{"d", "b", "f", "h", "j"} {
+		tree.Upsert([]byte(k), []byte("value_"+k))
+	}
+
+	testCases := []struct {
+		name string
+		node *Node
+		exp  string
+	}{
+		{"min", tree.Min(), "b"},
+		{"max", tree.Max(), "j"},
+		{"floor exact", tree.Floor([]byte("f")), "f"},
+		{"floor between", tree.Floor([]byte("g")), "f"},
+		{"floor above", tree.Floor([]byte("z")), "j"},
+		{"floor below", tree.Floor([]byte("a")), ""},
+		{"ceiling exact", tree.Ceiling([]byte("f")), "f"},
+		{"ceiling between", tree.Ceiling([]byte("e")), "f"},
+		{"ceiling below", tree.Ceiling([]byte("a")), "b"},
+		{"ceiling above", tree.Ceiling([]byte("z")), ""},
+	}
+
+	for _, tc := range testCases {
+		var key string
+		if tc.node != nil {
+			key = string(tc.node.Key)
+		}
+		if key != tc.exp {
+			t.Errorf("%v: expected %q but got %q", tc.name, tc.exp, key)
+		}
+	}
+}
+
+func TestTreeRange(t *testing.T) {
+	var tree Tree
+	var all []string
+
+	for i := 0; i < 1e3; i++ {
+		rdKey := randString(2)
+		if _, found := tree.Get([]byte(rdKey)); !found {
+			all = append(all, rdKey)
+		}
+		tree.Upsert([]byte(rdKey), nil)
+	}
+	sort.Strings(all)
+
+	for i := 0; i < 100; i++ {
+		from, to := randString(1), randString(2)
+		if rand.Intn(10) == 0 {
+			to = ""
+		}
+		limit := 1 + rand.Intn(50)
+
+		var exp []string
+		for _, k := range all {
+			if k >= from && (to == "" || k < to) && len(exp) < limit {
+				exp = append(exp, k)
+			}
+		}
+
+		var keys []string
+		tree.Range([]byte(from), []byte(to), func(n *Node) bool {
+			keys = append(keys, string(n.Key))
+			return len(keys) < limit
+		})
+		if len(keys) != len(exp) {
+			t.Fatalf("Range(%q, %q) limit %v: got %v keys, expected %v", from, to, limit, len(keys), len(exp))
+		}
+		for i := range keys {
+			if keys[i] != exp[i] {
+				t.Errorf("Range(%q, %q): invalid key, got %v, exp %v", from, to, keys[i], exp[i])
+			}
+		}
+	}
+}
+
+func TestTreeOrderStatistics(t *testing.T) {
+	var tree Tree
+	var all []string
+
+	if tree.Len() != 0 || tree.Select(0) != nil || tree.Rank([]byte("a")) != 0 {
+		t.Errorf("unexpected order statistics on an empty tree")
+	}
+
+	for i := 0; i < 1e3; i++ {
+		rdKey := randString(2)
+		if _, found := tree.Get([]byte(rdKey)); !found {
+			all = append(all, rdKey)
+		}
+		tree.Upsert([]byte(rdKey), nil)
+		if i%2 == 0 {
+			tree.Delete([]byte(all[0]))
+			all = all[1:]
+		}
+	}
+	sort.Strings(all)
+	checkInvariants(t, &tree)
+
+	if tree.Len() != len(all) {
+		t.Errorf("unexpected Len: %v != %v", tree.Len(), len(all))
+	}
+
+	for i, k := range all {
+		if n := tree.Select(i); n == nil || string(n.Key) != k {
+			t.Fatalf("Select(%v) should be %v", i, k)
+		}
+		if r := tree.Rank([]byte(k)); r != i {
+			t.Errorf("Rank(%v): %v != %v", k, r, i)
+		}
+	}
+	if tree.Select(len(all)) != nil || tree.Select(-1) != nil {
+		t.Errorf("Select out of range should return nil")
+	}
+
+	for i := 0; i < 100; i++ {
+		key := randString(2)
+		if r, exp := tree.Rank([]byte(key)), sort.SearchStrings(all, key); r != exp {
+			t.Errorf("Rank(%v): %v != %v", key, r, exp)
+		}
+	}
+}
+
 func randString(sz int) string {
 	const alpha = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	buf := make([]byte, sz)
@@ -132,22 +306,24 @@ func checkInvariants(t *testing.T, tree *Tree) {
 	checkKeyOrder(t, tree)
 	checkBalance(t, tree)
 	checkHeight(t, tree)
+	checkSize(t, tree)
+	checkBytes(t, tree)
 }
 
 func checkKeyOrder(t *testing.T, tree *Tree) {
 	var prev string
 	tree.InorderTraversal(func(n *Node) {
-		if n.Key < prev {
-			t.Errorf("invalid order: %v < %v", n.Key, prev)
+		if string(n.Key) < prev {
+			t.Errorf("invalid order: %v < %v", string(n.Key), prev)
 		}
-		prev = n.Key
+		prev = string(n.Key)
 	})
 }
 
 func checkBalance(t *testing.T, tree *Tree) {
 	tree.InorderTraversal(func(n *Node) {
 		if n.balance() < -1 || n.balance() > 1 {
-			t.Errorf("invalid balance for %v: %v", n.Key, n.balance())
+			t.Errorf("invalid balance for %v: %v", string(n.Key), n.balance())
 		}
 	})
 }
@@ -155,12 +331,39 @@ func checkBalance(t *testing.T, tree *Tree) {
 func checkHeight(t *testing.T, tree *Tree) {
 	tree.InorderTraversal(func(n *Node) {
 		if n.h != computeHeight(n) {
-			t.Errorf("height invalid for %v: %v != %v", n.Key, n.h, computeHeight(n))
+			t.Errorf("height invalid for %v: %v != %v", string(n.Key), n.h, computeHeight(n))
 			t.FailNow()
 		}
 	})
 }
 
+func checkSize(t *testing.T, tree *Tree) {
+	tree.InorderTraversal(func(n *Node) {
+		if n.size != computeSize(n) {
+			t.Errorf("size invalid for %v: %v != %v", string(n.Key), n.size, computeSize(n))
+			t.FailNow()
+		}
+	})
+}
+
+func checkBytes(t *testing.T, tree *Tree) {
+	var exp int64
+	tree.InorderTraversal(func(n *Node) {
+		exp += nodeOverhead + int64(len(n.Key)+len(n.Value))
+	})
+	if tree.ApproximateSize() != exp {
+		t.Errorf("invalid memory usage: %v != %v", tree.ApproximateSize(), exp)
+	}
+}
+
+func computeSize(n *Node) int {
+	if n == nil {
+		return 0
+	}
+
+	return 1 + computeSize(n.left) + computeSize(n.right)
+}
+
 func computeHeight(n *Node) int {
 	if n == nil {
 		return 0
@@ -168,3 +371,159 @@ func computeHeight(n *Node) int {
 
 	return 1 + max(computeHeight(n.left), computeHeight(n.right))
 }
+
+func TestConcurrentUpsert(t *testing.T) {
+	var tree Tree
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2e4; i++ {
+				if rand.Intn(4) == 0 {
+					tree.Delete([]byte(randString(2)))
+				} else {
+					tree.Upsert([]byte(randString(2)), []byte(randString(4)))
+				}
+			}
+		}()
+	}
+
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+
+				// a snapshot must be valid and never change afterwards
+				root := tree.root.Load()
+				if err := validate(root, "", ""); err != nil {
+					errs <- err
+					return
+				}
+				before := snapshotKeys(root)
+				for i := 0; i < 10; i++ {
+					tree.Get([]byte(randString(2)))
+				}
+				after := snapshotKeys(root)
+				if before != after {
+					errs <- fmt.Errorf("snapshot changed")
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	for r := 0; r < 4; r++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	checkInvariants(t, &tree)
+}
+
+func snapshotKeys(n *Node) string {
+	var sb strings.Builder
+	inorderTraversal(n, func(n *Node) {
+		sb.Write(n.Key)
+		sb.Write(n.Value)
+	})
+	return sb.String()
+}
+
+// validate checks the invariants of the subtree n,
+// with all keys in (low, high) when they are not empty
+func validate(n *Node, low, high string) error {
+	if n == nil {
+		return nil
+	}
+	if (low != "" && string(n.Key) <= low) || (high != "" && string(n.Key) >= high) {
+		return fmt.Errorf("invalid order for %v", string(n.Key))
+	}
+	if n.balance() < -1 || n.balance() > 1 {
+		return fmt.Errorf("invalid balance for %v: %v", string(n.Key), n.balance())
+	}
+	if n.h != max(n.left.height(), n.right.height())+1 {
+		return fmt.Errorf("height invalid for %v", string(n.Key))
+	}
+	if n.size != n.left.count()+n.right.count()+1 {
+		return fmt.Errorf("size invalid for %v", string(n.Key))
+	}
+	if err := validate(n.left, low, string(n.Key)); err != nil {
+		return err
+	}
+	return validate(n.right, string(n.Key), high)
+}
+
+type reverse struct{}
+
+func (reverse) Compare(a, b []byte) int { return -bytes.Compare(a, b) }
+func (reverse) Name() string            { return "test.Reverse" }
+
+func TestTreeComparator(t *testing.T) {
+	tree := New(reverse{})
+	var all []string
+
+	for i := 0; i < 1e3; i++ {
+		rdKey := randString(2)
+		if _, found := tree.Get([]byte(rdKey)); !found {
+			all = append(all, rdKey)
+		}
+		tree.Upsert([]byte(rdKey), []byte(rdKey))
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(all)))
+
+	var keys []string
+	tree.InorderTraversal(func(n *Node) {
+		keys = append(keys, string(n.Key))
+	})
+	checkKeys(t, keys, all)
+
+	for i, k := range all {
+		if r := tree.Rank([]byte(k)); r != i {
+			t.Errorf("Rank(%v): %v != %v", k, r, i)
+		}
+	}
+
+	it := tree.Iterator()
+	it.Seek([]byte(all[10]))
+	if !it.Valid() || string(it.Key()) != all[10] {
+		t.Errorf("Seek(%v) should find the key", all[10])
+	}
+}
+
+func TestTreeSnapshot(t *testing.T) {
+	var tree Tree
+	for i := 0; i < 100; i++ {
+		tree.Upsert([]byte(fmt.Sprintf("%03d", i)), []byte("v1"))
+	}
+
+	snap := tree.Snapshot()
+	for i := 0; i < 100; i += 2 {
+		tree.Upsert([]byte(fmt.Sprintf("%03d", i)), []byte("v2"))
+		tree.Delete([]byte(fmt.Sprintf("%03d", i+1)))
+	}
+	snap.Upsert([]byte("snap"), []byte("v3"))
+
+	checkInvariants(t, &tree)
+	checkInvariants(t, snap)
+
+	if snap.Len() != 101 || tree.Len() != 50 {
+		t.Errorf("unexpected lengths: snapshot %v, tree %v", snap.Len(), tree.Len())
+	}
+	if val, _ := snap.Get([]byte("000")); string(val) != "v1" {
+		t.Errorf("snapshot sees update: %s", val)
+	}
+	if _, found := tree.Get([]byte("snap")); found {
+		t.Errorf("tree sees snapshot update")
+	}
+}
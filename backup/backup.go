@@ -0,0 +1,383 @@
+/*
+Package backup implements incremental backups of a database.
+
+SSTables are immutable, so each table is stored only once in the backup
+directory and every backup only records the list of tables it is made
+of, along with a copy of the WAL. Tables are stored under the sha256 of
+their content: table names are only unique within the lifetime of a
+database, a restored one reuses them for different tables.
+
+Directory layout:
+
+	tables/SHA256.sst        tables shared by all the backups
+	backups/NNNNNN/tables    list of "name size sha256" lines, earliest table first
+	backups/NNNNNN/wal.dat   WAL at the time of the backup
+
+The backup directory is locked while a backup is created or deleted, so
+that tables aren't removed while they are copied or listed. Restored
+tables are checked against their hash.
+*/
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jrouviere/minikv/db"
+)
+
+const (
+	tablesDir    = "tables"
+	backupsDir   = "backups"
+	listFilename = "tables"
+	walFilename  = "wal.dat"
+)
+
+type Engine struct {
+	dir string
+}
+
+// Info describes a backup
+type Info struct {
+	ID     int
+	Tables []Table
+}
+
+type Table struct {
+	Name string
+	Size int64
+	Sum  string // hex sha256 of the content
+}
+
+// file returns the name of the table in the tables directory
+func (t Table) file() string {
+	return t.Sum + ".sst"
+}
+
+// Open opens the backup directory dir, creating it if needed.
+func Open(dir string) (*Engine, error) {
+	for _, sub := range []string{tablesDir, backupsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Engine{dir: dir}, nil
+}
+
+// Create backs up the current state of d and returns the new backup ID.
+// Only the tables not already present in the backup directory are copied.
+func (e *Engine) Create(d *db.DB) (int, error) {
+	l, err := lockDir(e.dir, true)
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+
+	ids, err := e.ids()
+	if err != nil {
+		return 0, err
+	}
+	id := 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+
+	tmpDir := filepath.Join(e.dir, backupsDir, fmt.Sprintf(".tmp-%06d", id))
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = d.LiveFiles(func(tables []string, wal []byte) error {
+		var list []Table
+		for _, src := range tables {
+			t, err := e.storeTable(src)
+			if err != nil {
+				return err
+			}
+			list = append(list, t)
+		}
+
+		if err := writeList(filepath.Join(tmpDir, listFilename), list); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(tmpDir, walFilename), wal, 0644)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmpDir, e.backupPath(id)); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// storeTable copies src into the shared tables directory,
+// unless a table with the same content is already there.
+func (e *Engine) storeTable(src string) (Table, error) {
+	t, err := hashTable(src)
+	if err != nil {
+		return Table{}, err
+	}
+
+	dest := filepath.Join(e.dir, tablesDir, t.file())
+	if _, err := os.Stat(dest); err == nil {
+		return t, nil
+	}
+
+	tmp := dest + ".tmp"
+	if _, _, err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return Table{}, err
+	}
+	return t, os.Rename(tmp, dest)
+}
+
+func hashTable(src string) (Table, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return Table{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return Table{}, err
+	}
+	return Table{Name: filepath.Base(src), Size: size, Sum: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// List returns all the backups, oldest first.
+func (e *Engine) List() ([]Info, error) {
+	l, err := lockDir(e.dir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return e.list()
+}
+
+func (e *Engine) list() ([]Info, error) {
+	ids, err := e.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for _, id := range ids {
+		tables, err := readList(filepath.Join(e.backupPath(id), listFilename))
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, Info{ID: id, Tables: tables})
+	}
+	return infos, nil
+}
+
+// Restore writes backup id in destDir, which must be empty or not exist.
+// The result can be opened with db.New.
+func (e *Engine) Restore(id int, destDir string) error {
+	l, err := lockDir(e.dir, false)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	tables, err := readList(filepath.Join(e.backupPath(id), listFilename))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("restore destination is not empty: %s", destDir)
+	}
+
+	for _, t := range tables {
+		src := filepath.Join(e.dir, tablesDir, t.file())
+		size, sum, err := copyFile(src, filepath.Join(destDir, t.Name))
+		if err != nil {
+			return err
+		}
+		if size != t.Size || sum != t.Sum {
+			return fmt.Errorf("corrupted backup table %s: %d bytes, sha256 %s", src, size, sum)
+		}
+	}
+
+	_, _, err = copyFile(filepath.Join(e.backupPath(id), walFilename), filepath.Join(destDir, walFilename))
+	return err
+}
+
+// Delete removes backup id, and the tables no other backup uses.
+func (e *Engine) Delete(id int) error {
+	l, err := lockDir(e.dir, true)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	if err := os.RemoveAll(e.backupPath(id)); err != nil {
+		return err
+	}
+	return e.removeUnused()
+}
+
+// Prune deletes all but the keep most recent backups.
+func (e *Engine) Prune(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("invalid number of backups to keep: %d", keep)
+	}
+
+	l, err := lockDir(e.dir, true)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	ids, err := e.ids()
+	if err != nil {
+		return err
+	}
+
+	for len(ids) > keep {
+		if err := os.RemoveAll(e.backupPath(ids[0])); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return e.removeUnused()
+}
+
+// removeUnused removes the tables no backup uses,
+// the directory must be locked
+func (e *Engine) removeUnused() error {
+	infos, err := e.list()
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, info := range infos {
+		for _, t := range info.Tables {
+			used[t.file()] = true
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(e.dir, tablesDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			if err := os.Remove(filepath.Join(e.dir, tablesDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ids returns the ID of every complete backup, in increasing order
+func (e *Engine) ids() ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(e.dir, backupsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (e *Engine) backupPath(id int) string {
+	return filepath.Join(e.dir, backupsDir, fmt.Sprintf("%06d", id))
+}
+
+func writeList(filename string, tables []Table) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, t := range tables {
+		fmt.Fprintf(w, "%s %d %s\n", t.Name, t.Size, t.Sum)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readList(filename string) ([]Table, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tables []Table
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid backup list %s: %q", filename, sc.Text())
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup list %s: %w", filename, err)
+		}
+		tables = append(tables, Table{Name: fields[0], Size: size, Sum: fields[2]})
+	}
+	return tables, sc.Err()
+}
+
+// copyFile copies src to dest, it returns the size
+// and the hex sha256 of the content
+func copyFile(src, dest string) (size int64, sum string, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return 0, "", err
+	}
+
+	h := sha256.New()
+	if size, err = io.Copy(io.MultiWriter(out, h), in); err != nil {
+		out.Close()
+		return 0, "", err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), out.Close()
+}
@@ -0,0 +1,254 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jrouviere/minikv/db"
+)
+
+func TestBackupRestore(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "minidb-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	os.Mkdir(filepath.Join(tmpDir, "db"), 0755)
+	store, err := db.New(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	engine, err := Open(filepath.Join(tmpDir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int
+	for i := 0; i < 3; i++ {
+		store.Set("key_"+strconv.Itoa(i), "flushed")
+		if err := store.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		store.Set("wal", strconv.Itoa(i))
+
+		id, err := engine.Create(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	tables, _ := os.ReadDir(filepath.Join(tmpDir, "backup", tablesDir))
+	if len(tables) != 3 {
+		t.Errorf("each table should be stored once, got %v", len(tables))
+	}
+
+	for i, id := range ids {
+		dest := filepath.Join(tmpDir, "restore", strconv.Itoa(id))
+		if err := engine.Restore(id, dest); err != nil {
+			t.Fatal(err)
+		}
+
+		restored, err := db.New(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 3; k++ {
+			exp := ""
+			if k <= i {
+				exp = "flushed"
+			}
+			if v := restored.Get("key_" + strconv.Itoa(k)); v != exp {
+				t.Errorf("backup %v: unexpected value for key_%v: %q", id, k, v)
+			}
+		}
+		if v := restored.Get("wal"); v != strconv.Itoa(i) {
+			t.Errorf("backup %v: unexpected wal value: %q", id, v)
+		}
+		restored.Close()
+	}
+
+	if err := engine.Prune(-1); err == nil {
+		t.Errorf("Prune should reject a negative count")
+	}
+	if err := engine.Prune(1); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := engine.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].ID != ids[2] {
+		t.Errorf("unexpected backups after prune: %+v", infos)
+	}
+
+	// merging replaces all the tables, the old ones are not needed anymore
+	if err := store.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Create(store); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Prune(1); err != nil {
+		t.Fatal(err)
+	}
+	tables, _ = os.ReadDir(filepath.Join(tmpDir, "backup", tablesDir))
+	if len(tables) != 1 {
+		t.Errorf("unused tables were not pruned, got %v", len(tables))
+	}
+}
+
+func TestBackupRestoredDB(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "minidb-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := Open(filepath.Join(tmpDir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(dir string) *db.DB {
+		t.Helper()
+		d, err := db.New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	os.Mkdir(filepath.Join(tmpDir, "db"), 0755)
+	orig := open(filepath.Join(tmpDir, "db"))
+	defer orig.Close()
+	orig.Set("a", "1")
+	orig.Flush()
+	first, err := engine.Create(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig.Set("b", "2")
+	orig.Flush()
+	if _, err := engine.Create(orig); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restored DB writes a table with the same name and size
+	// as the second table of the original one
+	if err := engine.Restore(first, filepath.Join(tmpDir, "restored")); err != nil {
+		t.Fatal(err)
+	}
+	restored := open(filepath.Join(tmpDir, "restored"))
+	defer restored.Close()
+	restored.Set("c", "3")
+	restored.Flush()
+	id, err := engine.Create(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := engine.Restore(id, filepath.Join(tmpDir, "check")); err != nil {
+		t.Fatal(err)
+	}
+	check := open(filepath.Join(tmpDir, "check"))
+	defer check.Close()
+	for k, exp := range map[string]string{"a": "1", "b": "", "c": "3"} {
+		if v := check.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+}
+
+func TestBackupCorruptedTable(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "minidb-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := Open(filepath.Join(tmpDir, "backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Mkdir(filepath.Join(tmpDir, "db"), 0755)
+	store, err := db.New(filepath.Join(tmpDir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.Set("a", "1")
+	store.Flush()
+	id, err := engine.Create(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := engine.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpDir, "backup", tablesDir, infos[0].Tables[0].file())
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-1] ^= 0xff
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := engine.Restore(id, filepath.Join(tmpDir, "restored")); err == nil {
+		t.Errorf("corrupted table should fail the restore")
+	}
+}
+
+func TestBackupLock(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "minidb-tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	engine, err := Open(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a backup being created by another process
+	l, err := lockDir(tmpDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(tmpDir, tablesDir, "table.sst.tmp")
+	if err := os.WriteFile(tmp, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- engine.Prune(0)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Prune didn't wait for the lock: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("table of the backup being created was removed: %v", err)
+	}
+
+	if err := l.release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
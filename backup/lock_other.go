@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package backup
+
+// dirLock is a no-op on platforms without flock, concurrent
+// processes are not detected there.
+type dirLock struct{}
+
+func lockDir(dir string, exclusive bool) (*dirLock, error) {
+	return &dirLock{}, nil
+}
+
+func (l *dirLock) release() error {
+	return nil
+}
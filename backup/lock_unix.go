@@ -0,0 +1,42 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// dirLock is an advisory flock held on the backup directory, so that
+// a backup being created doesn't lose its tables to a concurrent prune.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir waits for an exclusive lock to modify dir, or a shared one
+// to read it
+func lockDir(dir string, exclusive bool) (*dirLock, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &dirLock{file: f}, nil
+}
+
+func (l *dirLock) release() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,95 @@
+// Command minikv-backup manages incremental backups of a minikv
+// data directory. The database must not be opened by another process
+// while it is backed up, live databases should use the backup package.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/jrouviere/minikv/backup"
+	"github.com/jrouviere/minikv/db"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: minikv-backup -dir BACKUPDIR COMMAND
+
+commands:
+  create DBDIR         backup the database in DBDIR
+  list                 list existing backups
+  restore ID DESTDIR   restore backup ID in DESTDIR
+  prune KEEP           delete all but the KEEP most recent backups
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	dir := flag.String("dir", "./backup/", "backup directory")
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := run(*dir, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, args []string) error {
+	if len(args) == 0 {
+		usage()
+	}
+
+	engine, err := backup.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		store, err := db.OpenReadOnly(args[1])
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		id, err := engine.Create(store)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created backup %d\n", id)
+
+	case args[0] == "list" && len(args) == 1:
+		infos, err := engine.List()
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			var size int64
+			for _, t := range info.Tables {
+				size += t.Size
+			}
+			fmt.Printf("%d: %d tables, %d bytes\n", info.ID, len(info.Tables), size)
+		}
+
+	case args[0] == "restore" && len(args) == 3:
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return engine.Restore(id, args[2])
+
+	case args[0] == "prune" && len(args) == 2:
+		keep, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+		return engine.Prune(keep)
+
+	default:
+		usage()
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package collection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+)
+
+// Codec converts values of type T to and from bytes. Codecs used for
+// keys should preserve order: the bytewise order of the encoded values
+// must match the order of the values, otherwise range iteration follows
+// the encoded order.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+var errLength = errors.New("collection: invalid encoded integer length")
+
+// JSON encodes values with encoding/json, it doesn't preserve order.
+type JSON[T any] struct{}
+
+func (JSON[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSON[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// Gob encodes values with encoding/gob, it doesn't preserve order.
+type Gob[T any] struct{}
+
+func (Gob[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (Gob[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
+
+// Bytes stores byte slices as they are.
+type Bytes struct{}
+
+func (Bytes) Encode(v []byte) ([]byte, error) { return v, nil }
+func (Bytes) Decode(b []byte) ([]byte, error) { return b, nil }
+
+// String stores strings as their bytes.
+type String struct{}
+
+func (String) Encode(v string) ([]byte, error) { return []byte(v), nil }
+func (String) Decode(b []byte) (string, error) { return string(b), nil }
+
+// Int64 encodes integers on 8 big-endian bytes with the sign bit
+// flipped, so that negative numbers sort first.
+type Int64 struct{}
+
+func (Int64) Encode(v int64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)), nil
+}
+
+func (Int64) Decode(b []byte) (int64, error) {
+	if len(b) != 8 {
+		return 0, errLength
+	}
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63)), nil
+}
+
+// Uint64 encodes integers on 8 big-endian bytes.
+type Uint64 struct{}
+
+func (Uint64) Encode(v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, v), nil
+}
+
+func (Uint64) Decode(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, errLength
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
@@ -0,0 +1,168 @@
+/*
+Package collection provides typed access to a DB.
+
+A Collection stores keys of type K and values of type V, converted with
+a Codec. Several collections can share a DB: each key is stored as the
+tuple (collection name, encoded key), so that collections never overlap
+and each one is a contiguous range of the DB. This relies on the DB
+using comparator.Bytewise.
+*/
+package collection
+
+import (
+	"fmt"
+
+	"github.com/jrouviere/minikv/db"
+	"github.com/jrouviere/minikv/tuple"
+)
+
+type Collection[K, V any] struct {
+	db     *db.DB
+	name   string
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// New returns the collection called name stored in d
+func New[K, V any](d *db.DB, name string, keys Codec[K], values Codec[V]) *Collection[K, V] {
+	return &Collection[K, V]{
+		db:     d,
+		name:   name,
+		keys:   keys,
+		values: values,
+	}
+}
+
+func (c *Collection[K, V]) key(k K) ([]byte, error) {
+	b, err := c.keys.Encode(k)
+	if err != nil {
+		return nil, err
+	}
+	return tuple.Tuple{c.name, b}.Pack(), nil
+}
+
+// Put stores v for k. Values encoded to an empty slice can't be stored
+// since the DB treats them as deletions.
+func (c *Collection[K, V]) Put(k K, v V) error {
+	key, err := c.key(k)
+	if err != nil {
+		return err
+	}
+	val, err := c.values.Encode(v)
+	if err != nil {
+		return err
+	}
+	if len(val) == 0 {
+		return fmt.Errorf("collection %s: cannot store an empty value", c.name)
+	}
+	return c.db.Put(key, val)
+}
+
+// Get returns the value of k, found is false if it doesn't exist
+func (c *Collection[K, V]) Get(k K) (v V, found bool, err error) {
+	key, err := c.key(k)
+	if err != nil {
+		return v, false, err
+	}
+	val, found, err := c.db.GetBytes(key)
+	if err != nil || !found {
+		return v, false, err
+	}
+	v, err = c.values.Decode(val)
+	return v, err == nil, err
+}
+
+func (c *Collection[K, V]) Delete(k K) error {
+	key, err := c.key(k)
+	if err != nil {
+		return err
+	}
+	return c.db.Put(key, nil)
+}
+
+// Iterator walks the keys of a collection in the order of their encoding
+type Iterator[K, V any] struct {
+	c  *Collection[K, V]
+	it *db.Iterator
+
+	key   K
+	value V
+	err   error
+}
+
+// NewIterator returns an iterator over the keys in [start, end),
+// a nil start or end means no lower or upper bound. Next must be
+// called to move to the first key.
+func (c *Collection[K, V]) NewIterator(start, end *K) (*Iterator[K, V], error) {
+	lower, upper := tuple.Tuple{c.name}.Range()
+
+	var err error
+	if start != nil {
+		if lower, err = c.key(*start); err != nil {
+			return nil, err
+		}
+	}
+	if end != nil {
+		if upper, err = c.key(*end); err != nil {
+			return nil, err
+		}
+	}
+
+	it, err := c.db.NewIterator(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator[K, V]{c: c, it: it}, nil
+}
+
+// Next decodes the next key and value, it returns false once there are
+// no more keys or an error occurred.
+func (it *Iterator[K, V]) Next() bool {
+	if it.err != nil || !it.it.Next() {
+		return false
+	}
+
+	t, err := tuple.Unpack(it.it.Key())
+	if err != nil {
+		it.err = err
+		return false
+	}
+	var b []byte
+	if len(t) == 2 {
+		b, _ = t[1].([]byte)
+	}
+	if b == nil {
+		it.err = fmt.Errorf("collection %s: unexpected key %v", it.c.name, t)
+		return false
+	}
+
+	if it.key, it.err = it.c.keys.Decode(b); it.err != nil {
+		return false
+	}
+	// the iterator buffer is reused, values are decoded from a copy
+	val := append([]byte{}, it.it.Value()...)
+	if it.value, it.err = it.c.values.Decode(val); it.err != nil {
+		return false
+	}
+	return true
+}
+
+func (it *Iterator[K, V]) Key() K {
+	return it.key
+}
+
+func (it *Iterator[K, V]) Value() V {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator[K, V]) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
+
+func (it *Iterator[K, V]) Close() error {
+	return it.it.Close()
+}
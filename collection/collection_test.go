@@ -0,0 +1,77 @@
+package collection
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jrouviere/minikv/db"
+)
+
+type user struct {
+	Name  string
+	Admin bool
+}
+
+func collect[K, V any](t *testing.T, c *Collection[K, V], start, end *K) []K {
+	it, err := c.NewIterator(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var keys []K
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestCollection(t *testing.T) {
+	d, err := db.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	users := New[int64, user](d, "users", Int64{}, JSON[user]{})
+	groups := New[string, user](d, "users\x00", String{}, Gob[user]{})
+
+	for _, id := range []int64{5, -3, 1 << 40, 0} {
+		if err := users.Put(id, user{Name: "u"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := groups.Put("\xff", user{Name: "admins", Admin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := collect(t, users, nil, nil), []int64{-3, 5, 1 << 40}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+	start, end := int64(0), int64(1<<40)
+	if got, want := collect(t, users, &start, &end), []int64{5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys in [0, 1<<40) = %v, want %v", got, want)
+	}
+
+	if _, found, err := users.Get(0); err != nil || found {
+		t.Errorf("deleted key found: %v, %v", found, err)
+	}
+	g, found, err := groups.Get("\xff")
+	if err != nil || !found || g != (user{Name: "admins", Admin: true}) {
+		t.Errorf("Get = %v, %v, %v", g, found, err)
+	}
+	if got := collect(t, groups, nil, nil); len(got) != 1 {
+		t.Errorf("groups keys = %q", got)
+	}
+
+	raw := New[[]byte, []byte](d, "raw", Bytes{}, Bytes{})
+	if err := raw.Put([]byte("k"), nil); err == nil {
+		t.Error("storing an empty value should fail")
+	}
+}
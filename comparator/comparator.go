@@ -0,0 +1,29 @@
+// Package comparator defines the ordering of the keys.
+package comparator
+
+import "bytes"
+
+// Comparator defines a total order on keys, it must be used
+// consistently for the whole life of a database.
+type Comparator interface {
+	// Compare returns a negative number if a < b, 0 if a == b
+	// and a positive number if a > b
+	Compare(a, b []byte) int
+
+	// Name identifies the ordering, it is stored in the sstables
+	// so that they are never read with a different comparator
+	Name() string
+}
+
+// Bytewise orders keys lexicographically, it is the default comparator.
+var Bytewise Comparator = bytewise{}
+
+type bytewise struct{}
+
+func (bytewise) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewise) Name() string {
+	return "minikv.Bytewise"
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jrouviere/minikv/store"
+)
+
+// LiveFiles freezes the current set of sstables and calls f with their
+// paths, from earliest to latest, and a copy of the WAL matching them.
+// The files are guaranteed to stay on disk until f returns, even if a
+// concurrent compaction replaces them. Writers are only blocked while
+// the set is captured, not while f runs.
+func (db *DB) LiveFiles(f func(tables []string, wal []byte) error) error {
+	db.mu.RLock()
+	ssts := make([]*store.SSTable, len(db.store))
+	copy(ssts, db.store)
+	for _, sst := range ssts {
+		sst.Ref()
+	}
+
+	wal, err := os.ReadFile(filepath.Join(db.dirname, walFilename))
+	db.mu.RUnlock()
+
+	defer func() {
+		for _, sst := range ssts {
+			sst.Unref()
+		}
+	}()
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tables := make([]string, len(ssts))
+	for i, sst := range ssts {
+		tables[i] = sst.Filename()
+	}
+
+	return f(tables, wal)
+}
+
+// Checkpoint writes a consistent copy of the database in destDir, which
+// must be empty or not exist. Tables are hard-linked when possible and
+// copied otherwise, the resulting directory can be opened with New.
+//
+// There is no separate manifest: the set of data_NNNN.sst files is what
+// New loads, so the linked tables, keeping their names, describe the
+// checkpoint.
+func (db *DB) Checkpoint(destDir string) error {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("checkpoint destination is not empty: %s", destDir)
+	}
+
+	return db.LiveFiles(func(tables []string, wal []byte) error {
+		for _, table := range tables {
+			dest := filepath.Join(destDir, filepath.Base(table))
+			if err := linkOrCopy(table, dest); err != nil {
+				return err
+			}
+		}
+
+		return writeFileSync(filepath.Join(destDir, walFilename), wal)
+	})
+}
+
+func linkOrCopy(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeFileSync(filename string, data []byte) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
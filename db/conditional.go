@@ -0,0 +1,65 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/jrouviere/minikv/store"
+)
+
+// CompareAndSwap stores new for key if its current value is old, a nil
+// or empty old means that the key must not exist. It returns whether the
+// value was swapped. key, old and new can be reused once it returns.
+func (db *DB) CompareAndSwap(key, old, new []byte) (bool, error) {
+	return db.putIf(key, new, func(cur []byte, found bool) bool {
+		if len(old) == 0 {
+			return !found
+		}
+		return found && bytes.Equal(cur, old)
+	})
+}
+
+// PutIfAbsent stores value for key unless the key exists,
+// it returns whether the value was stored.
+func (db *DB) PutIfAbsent(key, value []byte) (bool, error) {
+	return db.putIf(key, value, func(_ []byte, found bool) bool {
+		return !found
+	})
+}
+
+// DeleteIfEquals deletes key if its current value is value,
+// it returns whether the key was deleted.
+func (db *DB) DeleteIfEquals(key, value []byte) (bool, error) {
+	return db.putIf(key, nil, func(cur []byte, found bool) bool {
+		return found && bytes.Equal(cur, value)
+	})
+}
+
+// putIf writes value for key if cond holds for the current value of
+// key, checked in the same critical section as the write.
+func (db *DB) putIf(key, value []byte, cond func(cur []byte, found bool) bool) (bool, error) {
+	if db.readOnly {
+		return false, ErrReadOnly
+	}
+
+	release, err := db.lockKey(key)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	cur, found, err := db.opts.get(db.memtable, db.rangeDels, db.store, key)
+	if err != nil {
+		return false, err
+	}
+	if !cond(cur, found) {
+		return false, nil
+	}
+
+	if err := db.write([]store.Write{{Key: clone(key), Value: store.NewValue(value)}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -1,103 +1,521 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/jrouviere/minikv/avl"
+	"github.com/jrouviere/minikv/memtable"
 	"github.com/jrouviere/minikv/store"
 )
 
+const walFilename = "wal.dat"
+
+// ErrReadOnly is returned by write operations on a DB
+// opened with OpenReadOnly.
+var ErrReadOnly = errors.New("database is opened in read-only mode")
+
 type DB struct {
 	dirname   string
 	fileCount int32
+	readOnly  bool
+	opts      options
 
 	mu sync.RWMutex
 	// from earliest to latest sstable
 	store    []*store.SSTable
-	memtable *avl.Tree
+	memtable memtable.Memtable
 	wal      *store.WAL
+	lock     *dirLock
+	// memory used by the indexes of the sstables
+	indexSize int64
+
+	// range tombstones of the memtable, append only
+	rangeDels []store.RangeTombstone
+
+	// seq is incremented by each write, lastWrite and rangeWrites record
+	// the seq of the writes made while transactions are running
+	seq         uint64
+	txns        int
+	lastWrite   map[string]uint64
+	rangeWrites []rangeWrite
+
+	// seq of the last write before the current WAL
+	walBase  uint64
+	watchers map[*Watcher]struct{}
+
+	compactionStats store.CompactionStats
+
+	// key locks, owned by transactions and single writes
+	locks     *lockManager
+	lastOwner uint64
 }
 
-func New(dirname string) (*DB, error) {
-	walpath := filepath.Join(dirname, "wal.dat")
+// New opens the database stored in dirname. The directory is locked
+// exclusively until Close is called, New fails with ErrLocked if
+// another process is already using it.
+func New(dirname string, opts ...Option) (*DB, error) {
+	lock, err := lockDir(dirname, true)
+	if err != nil {
+		return nil, err
+	}
 
-	memtable, err := store.LoadWAL(walpath)
+	db, err := open(dirname, lock, false, opts)
 	if err != nil {
-		memtable = &avl.Tree{}
+		lock.release()
+		return nil, err
 	}
+	return db, nil
+}
 
-	wal, err := store.NewWAL(walpath)
+// OpenReadOnly opens the database stored in dirname without ever
+// modifying it: the WAL is replayed in memory only and no file is
+// created. Writes fail with ErrReadOnly. A shared lock is held on the
+// directory so that several readers can coexist, but not with a writer.
+func OpenReadOnly(dirname string, opts ...Option) (*DB, error) {
+	lock, err := lockDir(dirname, false)
 	if err != nil {
 		return nil, err
 	}
 
+	db, err := open(dirname, lock, true, opts)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	return db, nil
+}
+
+func open(dirname string, lock *dirLock, readOnly bool, opts []Option) (*DB, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	walpath := filepath.Join(dirname, walFilename)
+
 	db := &DB{
 		dirname:  dirname,
-		memtable: memtable,
-		wal:      wal,
+		readOnly: readOnly,
+		opts:     o,
+		memtable: o.newMemtable(o.cmp),
+		lock:     lock,
+		locks:    newLockManager(o.cmp),
+		watchers: make(map[*Watcher]struct{}),
 	}
 
 	if err := db.LoadSSTables(); err != nil {
 		return nil, err
 	}
 
-	if err := db.Flush(); err != nil {
+	// the WAL must not be rotated away if it can't be replayed,
+	// e.g. when merge operands are found without merge operator
+	if err := db.replay(walpath, db.flushedSeq()); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", walpath, err)
+	}
+
+	if readOnly {
+		return db, nil
+	}
+
+	// persist what was replayed from the WAL, and start a new one
+	if !db.memtableEmpty() {
+		if err := db.writeMemtable(); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.rotateWAL(); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func (db *DB) Set(key, value string) {
+// flushedSeq returns the sequence number of the last write
+// contained in the sstables
+func (db *DB) flushedSeq() uint64 {
+	var seq uint64
+	for _, sst := range db.store {
+		if sst.Seq() > seq {
+			seq = sst.Seq()
+		}
+	}
+	return seq
+}
+
+// replay applies the writes of the WAL following flushed to the memtable,
+// the previous ones are already in the sstables if the process stopped
+// before the WAL was rotated.
+func (db *DB) replay(walpath string, flushed uint64) error {
+	db.seq, db.walBase = flushed, flushed
+
+	r, err := store.OpenWAL(walpath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	db.walBase = r.Seq()
+	if db.walBase > db.seq {
+		db.seq = db.walBase
+	}
+	for {
+		seq, w, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if seq <= flushed {
+			continue
+		}
+		db.seq = seq
+
+		if w.Value, err = db.entry(w); err != nil {
+			return err
+		}
+		db.apply(w)
+	}
+}
+
+// Close releases the WAL and the directory lock,
+// the DB must not be used afterwards.
+func (db *DB) Close() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if err := db.wal.Commit(key, value); err != nil {
-		panic(err)
+	for w := range db.watchers {
+		w.stop()
+	}
+
+	var err error
+	if db.wal != nil {
+		err = db.wal.Close()
+	}
+	if lerr := db.lock.release(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+func (db *DB) Set(key, value string) error {
+	return db.put([]byte(key), store.NewValue([]byte(value)))
+}
+
+// SetWithTTL stores value for key, the key is deleted once ttl elapsed.
+func (db *DB) SetWithTTL(key, value string, ttl time.Duration) error {
+	return db.PutWithTTL([]byte(key), []byte(value), ttl)
+}
+
+// PutWithTTL is like Put, but the key is deleted once ttl elapsed.
+// Expired keys are hidden by reads and removed by compactions.
+func (db *DB) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return db.put(clone(key), store.NewExpiringValue(value, db.opts.now().Add(ttl)))
+}
+
+func (db *DB) Delete(key string) error {
+	return db.put([]byte(key), nil)
+}
+
+// Put stores value for key, an empty value deletes the key. The DB
+// doesn't keep any reference to key and value, they can be reused
+// as soon as Put returns.
+func (db *DB) Put(key, value []byte) error {
+	return db.put(clone(key), store.NewValue(value))
+}
+
+// Merge adds operand to the value of key with the operator set by
+// WithMergeOperator, without reading the current value: operands are
+// stored and only applied when the key is read or compacted. Operands
+// which the operator fails to apply are kept, reading the key returns a
+// store.MergeError until it is written again. Like Put, key and operand
+// can be reused as soon as Merge returns.
+func (db *DB) Merge(key, operand []byte) error {
+	if db.opts.mergeOperator == nil {
+		return store.ErrNoMergeOperator
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	release, err := db.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.write([]store.Write{{Key: clone(key), Value: store.NewOperand(operand)}})
+}
+
+// put takes ownership of key and value,
+// which is in its stored form
+func (db *DB) put(key, value []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	release, err := db.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.write([]store.Write{{Key: key, Value: value}})
+}
+
+// DeleteRange deletes all the keys in [start, end), a nil end means no
+// upper bound. Whatever the number of keys, it is stored as a single
+// range tombstone, the keys are only removed by compactions.
+// Like Delete, it waits for the keys in the range locked by pessimistic
+// transactions. start and end can be reused once it returns.
+func (db *DB) DeleteRange(start, end []byte) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if len(end) > 0 && db.opts.cmp.Compare(start, end) >= 0 {
+		return nil
+	}
+
+	r := store.RangeTombstone{Start: clone(start), End: clone(end)}
+	owner := db.newOwner()
+	if err := db.locks.acquireRange(owner, r, db.opts.lockTimeout); err != nil {
+		return err
 	}
+	defer db.locks.releaseRange(owner)
 
-	// store in memtable
-	db.memtable.Upsert(key, value)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.write([]store.Write{store.NewRangeDelete(r)})
+}
+
+// lockKey waits for the transactions holding key
+// and locks it until release is called
+func (db *DB) lockKey(key []byte) (release func(), err error) {
+	owner := db.newOwner()
+	if err := db.locks.acquire(owner, string(key), true, db.opts.lockTimeout); err != nil {
+		return nil, err
+	}
+	return func() {
+		db.locks.release(owner, string(key))
+	}, nil
 }
 
-func (db *DB) Delete(key string) {
-	db.Set(key, "")
+// newOwner returns a new identifier for the lock manager
+func (db *DB) newOwner() uint64 {
+	return atomic.AddUint64(&db.lastOwner, 1)
 }
 
+// write commits batch to the WAL and applies it to the memtable, db.mu
+// must be held. A batch of several writes, written by a transaction, is
+// made of point writes sorted by key without duplicates.
+func (db *DB) write(batch []store.Write) error {
+	// the entries are computed first, so that nothing is
+	// written if merge operands are written without operator
+	entries := make([][]byte, len(batch))
+	for i, w := range batch {
+		var err error
+		if entries[i], err = db.entry(w); err != nil {
+			return err
+		}
+	}
+
+	if err := db.wal.CommitBatch(batch); err != nil {
+		return err
+	}
+
+	if len(batch) == 1 {
+		db.apply(store.Write{Key: batch[0].Key, Value: entries[0]})
+	} else {
+		keys := make([][]byte, len(batch))
+		for i, w := range batch {
+			keys[i] = w.Key
+		}
+		db.memtable.PutSorted(keys, entries)
+	}
+
+	for _, w := range batch {
+		db.seq++
+		db.notify(db.seq, w)
+		if db.txns == 0 {
+			continue
+		}
+		if r, ok := w.RangeDelete(); ok {
+			db.rangeWrites = append(db.rangeWrites, rangeWrite{r, db.seq})
+		} else {
+			db.lastWrite[string(w.Key)] = db.seq
+		}
+	}
+
+	return db.maybeFlush()
+}
+
+// entry returns the memtable entry for w: there is a single entry per
+// key, so merge operands are stacked on the current one. The entry
+// doesn't depend on the time, the WAL replay must compute it again.
+func (db *DB) entry(w store.Write) ([]byte, error) {
+	if !store.IsOperand(w.Value) {
+		return w.Value, nil
+	}
+	cur, found := db.memtable.Get(w.Key)
+	if !found {
+		return w.Value, nil
+	}
+	return store.Stack(db.opts.mergeOperator, w.Key, w.Value, cur)
+}
+
+// apply applies w to the memtable, taking ownership of its slices
+func (db *DB) apply(w store.Write) {
+	r, ok := w.RangeDelete()
+	if !ok {
+		db.memtable.Put(w.Key, w.Value)
+		return
+	}
+
+	// the keys already in the memtable are deleted, so that the
+	// point entries of the memtable are newer than its range tombstones
+	var covered [][]byte
+	it := db.memtable.Iterator()
+	for it.Seek(r.Start); it.Valid() && r.Covers(db.opts.cmp, it.Key()); it.Next() {
+		if len(it.Value()) > 0 {
+			covered = append(covered, clone(it.Key()))
+		}
+	}
+	for _, key := range covered {
+		db.memtable.Put(key, nil)
+	}
+
+	db.rangeDels = append(db.rangeDels, r)
+}
+
+// rangeDeletes returns the range tombstones of the memtable,
+// db.mu must be held
+func (db *DB) rangeDeletes() []store.RangeTombstone {
+	return db.rangeDels[:len(db.rangeDels):len(db.rangeDels)]
+}
+
+// Get returns the value of key, empty if it doesn't exist or if its merge
+// operands can't be applied: GetBytes returns the error then.
 func (db *DB) Get(key string) string {
+	val, _, err := db.GetBytes([]byte(key))
+	var merr *store.MergeError
+	if err != nil && !errors.As(err, &merr) && !errors.Is(err, store.ErrNoMergeOperator) {
+		panic(err)
+	}
+	return string(val)
+}
+
+// GetBytes returns the value of key in a new buffer owned by the caller,
+// found is false if the key doesn't exist or was deleted.
+func (db *DB) GetBytes(key []byte) (val []byte, found bool, err error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
+	return db.opts.get(db.memtable, db.rangeDels, db.store, key)
+}
+
+// get looks for key in mem and tables, from new to old, until a value,
+// a deletion or a range tombstone covering key is found, applying the
+// merge operands found on the way. memDels are the range tombstones of mem.
+func (o *options) get(mem memtable.Reader, memDels []store.RangeTombstone, tables []*store.SSTable, key []byte) ([]byte, bool, error) {
 	// Here we could use a bloomfilter to speedup the case where
 	// the key is not in the DB.
 	// We could also use a cache for values that are frequently
 	// accessed.
 
 	// first check the memtable
-	if val, found := db.memtable.Get(key); found {
-		return val
-	}
+	l := o.lookup(mem, memDels, key, o.now())
 
-	// then check each sstable from new to old
-	for i := len(db.store) - 1; i >= 0; i-- {
-		val, found, err := db.store[i].Get(key)
+	// then check each sstable from new to old,
+	// a range tombstone hides the older tables
+	for i := len(tables) - 1; i >= 0 && !l.done(); i-- {
+		older, ok, err := tables[i].Get(key)
 		if err != nil {
-			panic(err)
+			return nil, false, err
 		}
-
-		if found {
-			return val
+		if ok {
+			if err := l.add(o, older); err != nil {
+				return nil, false, err
+			}
 		}
+		l.covered = store.Covered(o.cmp, tables[i].RangeTombstones(), key)
+	}
+
+	return l.result(o)
+}
+
+// lookup is the search of a key from the newest to the oldest level
+type lookup struct {
+	key     []byte
+	val     []byte
+	found   bool
+	covered bool // by a range tombstone of the levels seen
+	now     time.Time
+}
+
+// lookup starts the search of key at now in mem
+func (o *options) lookup(mem memtable.Reader, memDels []store.RangeTombstone, key []byte, now time.Time) lookup {
+	l := lookup{key: key, now: now}
+	l.val, l.found = mem.Get(key)
+	l.covered = store.Covered(o.cmp, memDels, key)
+	return l
+}
+
+// done returns true once the older levels can't change the result
+func (l *lookup) done() bool {
+	return l.covered || (l.found && !store.IsOperand(l.val))
+}
+
+// add applies the value stored for the key in an older level,
+// which must not be modified afterwards
+func (l *lookup) add(o *options, older []byte) error {
+	if !l.found {
+		l.val, l.found = older, true
+		return nil
 	}
 
-	return ""
+	var err error
+	l.val, err = store.Combine(o.mergeOperator, l.key, l.val, older, l.now)
+	return err
+}
+
+// result returns the value found, in a new buffer
+func (l *lookup) result(o *options) ([]byte, bool, error) {
+	if !l.found {
+		return nil, false, nil
+	}
+	// operands on top of a range tombstone are resolved as if the key
+	// didn't exist before them
+	val, found, err := store.Resolve(o.mergeOperator, l.key, l.val, l.now)
+	return clone(val), found, err
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
 }
 
 func (db *DB) MergeAll() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -105,15 +523,23 @@ func (db *DB) MergeAll() error {
 		sst1 := db.store[len(db.store)-2]
 		sst2 := db.store[len(db.store)-1]
 		merged := db.getNextFilename()
-		if err := store.Merge(sst1, sst2, merged); err != nil {
+		stats, err := store.Merge(sst1, sst2, merged, store.MergeOptions{
+			Operator: db.opts.mergeOperator,
+			Bottom:   len(db.store) == 2,
+			Now:      db.opts.now(),
+			Filter:   db.opts.compactionFilter,
+		})
+		db.compactionStats.Add(stats)
+		if err != nil {
 			return err
 		}
 
-		sstMerged, err := store.LoadSST(merged)
+		sstMerged, err := store.LoadSST(merged, db.opts.cmp)
 		if err != nil {
 			return err
 		}
 		db.store = append(db.store[:len(db.store)-2], sstMerged)
+		db.indexSize += sstMerged.MemoryUsage() - sst1.MemoryUsage() - sst2.MemoryUsage()
 
 		sst1.Delete()
 		sst2.Delete()
@@ -122,43 +548,193 @@ func (db *DB) MergeAll() error {
 	return nil
 }
 
-// Flush saves the memtable to disk and clear it
+// CompactionStats returns the counts accumulated by all the compactions
+// since the DB was opened.
+func (db *DB) CompactionStats() store.CompactionStats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.compactionStats
+}
+
+// Flush saves the memtable and its range tombstones to disk and clear it,
+// nothing is written if the memtable is empty.
 func (db *DB) Flush() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	return db.flush()
+}
+
+func (db *DB) flush() error {
+	if db.memtableEmpty() {
+		return nil
+	}
+	if err := db.writeMemtable(); err != nil {
+		return err
+	}
+	return db.rotateWAL()
+}
+
+func (db *DB) memtableEmpty() bool {
+	it := db.memtable.Iterator()
+	it.First()
+	return !it.Valid() && len(db.rangeDels) == 0
+}
+
+// writeMemtable writes the memtable in a new sstable and clears it
+func (db *DB) writeMemtable() error {
+	it := db.memtable.Iterator()
 	filename := db.getNextFilename()
-	if err := store.WriteFile(filename, db.memtable); err != nil {
+	if err := store.WriteFile(filename, db.opts.cmp, it, db.seq, db.rangeDels); err != nil {
 		return err
 	}
 
-	db.memtable = &avl.Tree{}
+	db.memtable = db.opts.newMemtable(db.opts.cmp)
+	db.rangeDels = nil
 
-	sst, err := store.LoadSST(filename)
+	sst, err := store.LoadSST(filename, db.opts.cmp)
 	if err != nil {
 		return err
 	}
 
 	db.store = append(db.store, sst)
+	db.indexSize += sst.MemoryUsage()
 
-	return db.wal.Reset()
+	return nil
 }
 
+// rotateWAL starts a new WAL, the current one is kept as a segment for
+// Watch, and the segments past the retention are removed.
+func (db *DB) rotateWAL() error {
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			return err
+		}
+	}
+
+	walpath := filepath.Join(db.dirname, walFilename)
+	if db.seq > db.walBase {
+		if err := os.Rename(walpath, db.segmentPath(db.walBase)); err != nil {
+			return err
+		}
+	}
+
+	wal, err := store.NewWAL(walpath, db.seq)
+	if err != nil {
+		return err
+	}
+	db.wal, db.walBase = wal, db.seq
+
+	segments, err := db.segments()
+	if err != nil {
+		return err
+	}
+	for len(segments) > db.opts.walRetention {
+		if err := os.Remove(db.segmentPath(segments[0])); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+// segmentPath returns the path of the WAL segment following
+// the sequence number base
+func (db *DB) segmentPath(base uint64) string {
+	return filepath.Join(db.dirname, fmt.Sprintf("wal_%020d.log", base))
+}
+
+// segments returns the base of the WAL segments on disk, in order
+func (db *DB) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(db.dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		var base uint64
+		if n, _ := fmt.Sscanf(e.Name(), "wal_%d.log", &base); n == 1 {
+			segments = append(segments, base)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// maybeFlush flushes the memtable when it grows past the flush threshold,
+// or when the memory budget is exceeded. Writers are stalled meanwhile
+// since it is called with db.mu held.
+func (db *DB) maybeFlush() error {
+	size := db.memtable.ApproximateSize()
+
+	switch {
+	case db.opts.flushThreshold > 0 && size >= db.opts.flushThreshold:
+		return db.flush()
+	case db.opts.memoryBudget > 0 && size > db.memtableBudget():
+		return db.flush()
+	}
+	return nil
+}
+
+// memtableBudget returns the part of the memory budget left to the
+// memtable by the indexes. Flushing can't reduce the indexes, so the
+// memtable always gets at least a quarter of the budget: otherwise each
+// write would flush once the indexes alone exceed it.
+func (db *DB) memtableBudget() int64 {
+	budget := db.opts.memoryBudget - db.indexUsage()
+	if floor := db.opts.memoryBudget / 4; budget < floor {
+		return floor
+	}
+	return budget
+}
+
+// MemoryUsage returns the approximate memory used by the memtable and the
+// in-memory index of the sstables, in bytes
+func (db *DB) MemoryUsage() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.memtable.ApproximateSize() + db.indexUsage()
+}
+
+func (db *DB) indexUsage() int64 {
+	return db.indexSize
+}
+
+// LoadSSTables loads every table found in the data directory.
+// Empty tables are skipped, and removed unless the DB is read-only.
 func (db *DB) LoadSSTables() error {
 	var max int32
 	err := filepath.WalkDir(db.dirname, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 		var num int32
 		n, _ := fmt.Sscanf(d.Name(), "data_%d.sst", &num)
 		if n == 1 {
 			if num > max {
 				max = num
 			}
-			sst, err := store.LoadSST(path)
+			sst, err := store.LoadSST(path, db.opts.cmp)
 			if err != nil {
 				return err
 			}
 
+			if sst.Empty() {
+				if db.readOnly {
+					return nil
+				}
+				return sst.Delete()
+			}
+
 			db.store = append(db.store, sst)
+			db.indexSize += sst.MemoryUsage()
 		}
 		return nil
 	})
@@ -1,23 +1,64 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/jrouviere/minikv/avl"
+	"github.com/jrouviere/minikv/comparator"
+	"github.com/jrouviere/minikv/memtable"
+	"github.com/jrouviere/minikv/merge"
+	"github.com/jrouviere/minikv/store"
 )
 
-func setup(b *testing.B) string {
+func setup(tb testing.TB) string {
 	dir, err := os.MkdirTemp("", "minidb-tests")
 	if err != nil {
-		b.Fatalf("cannot create temp dir: %v", err)
+		tb.Fatalf("cannot create temp dir: %v", err)
 	}
 	return dir
 }
 
-func teardown(b *testing.B, dir string) {
+func teardown(tb testing.TB, dir string) {
 	if err := os.RemoveAll(dir); err != nil {
-		b.Fatalf("unable to removeAll: %s: %+v", dir, err)
+		tb.Fatalf("unable to removeAll: %s: %+v", dir, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(tmpDir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New(tmpDir)
+	if err != nil {
+		t.Fatalf("cannot reopen after close: %v", err)
 	}
+	db.Close()
 }
 
 func BenchmarkSet(b *testing.B) {
@@ -111,3 +152,1774 @@ func BenchmarkAll(b *testing.B) {
 		db.Get("test")
 	}
 }
+
+func TestOpenReadOnly(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("flushed", "1")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("wal", "2")
+	db.Close()
+
+	before, _ := os.ReadDir(tmpDir)
+
+	ro, err := OpenReadOnly(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	if v := ro.Get("flushed"); v != "1" {
+		t.Errorf("unexpected value for flushed: %q", v)
+	}
+	if v := ro.Get("wal"); v != "2" {
+		t.Errorf("unexpected value for wal: %q", v)
+	}
+
+	if err := ro.Set("k", "v"); err != ErrReadOnly {
+		t.Errorf("Set: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Delete("k"); err != ErrReadOnly {
+		t.Errorf("Delete: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.Flush(); err != ErrReadOnly {
+		t.Errorf("Flush: expected ErrReadOnly, got %v", err)
+	}
+	if err := ro.MergeAll(); err != ErrReadOnly {
+		t.Errorf("MergeAll: expected ErrReadOnly, got %v", err)
+	}
+
+	if _, err := New(tmpDir); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked while a reader is open, got %v", err)
+	}
+
+	after, _ := os.ReadDir(tmpDir)
+	if len(before) != len(after) {
+		t.Errorf("read-only open modified the directory: %v != %v", before, after)
+	}
+
+	// a directory never opened by a writer is locked too
+	empty := filepath.Join(tmpDir, "empty")
+	os.Mkdir(empty, 0755)
+	ro2, err := OpenReadOnly(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro2.Close()
+	if _, err := New(empty); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected ErrLocked while a reader is open, got %v", err)
+	}
+}
+
+func TestNoEmptySSTables(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	// an empty table left by a previous version
+	if err := store.WriteFile(filepath.Join(tmpDir, "data_0001.sst"), comparator.Bytewise, (&avl.Tree{}).Iterator(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		db, err := New(tmpDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(tmpDir, "*.sst"))
+	if len(tables) != 0 {
+		t.Errorf("unexpected tables: %v", tables)
+	}
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("key", "value")
+	db.Close()
+
+	db, err = New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tables, _ = filepath.Glob(filepath.Join(tmpDir, "*.sst"))
+	if len(tables) != 1 {
+		t.Errorf("expected the replayed WAL in a single new table, got %v", tables)
+	}
+	if v := db.Get("key"); v != "value" {
+		t.Errorf("unexpected value: %q", v)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+	destDir := setup(t)
+	defer teardown(t, destDir)
+	destDir = filepath.Join(destDir, "checkpoint")
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		db.Set("key_"+strconv.Itoa(i), "flushed")
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Set("key_0", "wal")
+
+	err = db.LiveFiles(func(tables []string, wal []byte) error {
+		// a concurrent compaction must not remove pinned tables
+		if err := db.MergeAll(); err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if _, err := os.Stat(table); err != nil {
+				t.Errorf("pinned table was removed: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(tmpDir, "*.sst"))
+	if len(tables) != 1 {
+		t.Errorf("merged tables were not removed after unpinning: %v", tables)
+	}
+
+	if err := db.Checkpoint(destDir); err != nil {
+		t.Fatal(err)
+	}
+	db.Set("key_1", "after checkpoint")
+
+	cp, err := New(destDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+
+	for key, exp := range map[string]string{
+		"key_0": "wal",
+		"key_1": "flushed",
+		"key_2": "flushed",
+	} {
+		if v := cp.Get(key); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", key, v, exp)
+		}
+	}
+}
+
+// BenchmarkParallelSet measures concurrent writers of the DB, which are
+// serialized by the DB lock: the memtables never see concurrent writes
+// here, see BenchmarkParallelPut in memtable for that.
+func BenchmarkParallelSet(b *testing.B) {
+	for name, newMemtable := range map[string]func(cmp comparator.Comparator) memtable.Memtable{
+		"avl":      memtable.NewAVL,
+		"skiplist": memtable.NewSkiplist,
+	} {
+		b.Run(name, func(b *testing.B) {
+			tmpDir := setup(b)
+			defer teardown(b, tmpDir)
+
+			db, err := New(tmpDir, WithMemtable(newMemtable))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			var n int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+					db.Set("key_"+strconv.FormatInt(i, 10), "some test data")
+				}
+			})
+		})
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	const budget = 64 * 1024
+	db, err := New(tmpDir, WithMemoryBudget(budget))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	set := func(i int) {
+		t.Helper()
+		if err := db.Set("key_"+strconv.Itoa(i), "some test data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countTables := func() int {
+		tables, _ := filepath.Glob(filepath.Join(tmpDir, "*.sst"))
+		return len(tables)
+	}
+
+	// the budget holds until the indexes leave less than
+	// a quarter of it to the memtable
+	var n int
+	for ; db.indexUsage() <= budget; n++ {
+		set(n)
+		if usage := db.MemoryUsage(); usage > budget && db.indexUsage() < budget*3/4 {
+			t.Fatalf("memory budget exceeded: %v", usage)
+		}
+	}
+	if countTables() == 0 {
+		t.Errorf("the memtable was never flushed")
+	}
+
+	// once the indexes alone exceed the budget,
+	// writes must not each flush a new table
+	before := countTables()
+	for i := 0; i < 1e4; i++ {
+		set(n + i)
+		if size := db.memtable.ApproximateSize(); size > budget/4 {
+			t.Fatalf("memtable exceeds its share of the budget: %v", size)
+		}
+	}
+	if flushes := countTables() - before; flushes > 100 {
+		t.Errorf("too many flushes past the budget: %v", flushes)
+	}
+
+	if v := db.Get("key_42"); v != "some test data" {
+		t.Errorf("unexpected value: %q", v)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	all := make(map[string]string)
+	buf := make([]byte, 0, 16)
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("key_%03d", rand.Intn(300))
+		v := strconv.Itoa(i)
+		if i%7 == 0 {
+			v = ""
+		}
+
+		// the DB must not keep references to the buffers
+		buf = append(buf[:0], v...)
+		if err := db.Put([]byte(k), buf); err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf[:0], "overwritten"...)
+		all[k] = v
+
+		if i%150 == 0 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var keys []string
+	for k, v := range all {
+		if v != "" {
+			keys = append(keys, k)
+		}
+		val, found, err := db.GetBytes([]byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (v != "") || string(val) != v {
+			t.Errorf("GetBytes(%v): %q, %v", k, val, found)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, tc := range []struct {
+		start, end []byte
+	}{
+		{nil, nil},
+		{[]byte("key_100"), nil},
+		{nil, []byte("key_200")},
+		{[]byte("key_050"), []byte("key_051")},
+		{[]byte("key_1005"), []byte("key_2")},
+	} {
+		var exp []string
+		for _, k := range keys {
+			if (tc.start == nil || k >= string(tc.start)) && (tc.end == nil || k < string(tc.end)) {
+				exp = append(exp, k)
+			}
+		}
+
+		it, err := db.NewIterator(tc.start, tc.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// compaction must not disturb an open iterator
+		if err := db.MergeAll(); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for it.Next() {
+			if string(it.Value()) != all[string(it.Key())] {
+				t.Errorf("unexpected value for %s: %s", it.Key(), it.Value())
+			}
+			got = append(got, string(it.Key()))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		it.Close()
+
+		if strings.Join(got, ",") != strings.Join(exp, ",") {
+			t.Errorf("[%s, %s): got %v, expected %v", tc.start, tc.end, got, exp)
+		}
+	}
+}
+
+type reverse struct{}
+
+func (reverse) Compare(a, b []byte) int { return -bytes.Compare(a, b) }
+func (reverse) Name() string            { return "test.Reverse" }
+
+func TestComparator(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithComparator(reverse{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b", "d", "a", "c"} {
+		db.Set(k, "value_"+k)
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Set("e", "value_e")
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := db.NewIterator([]byte("d"), []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Close()
+	if strings.Join(keys, ",") != "d,c,b" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	if v := db.Get("b"); v != "value_b" {
+		t.Errorf("unexpected value: %q", v)
+	}
+	db.Close()
+
+	if _, err := New(tmpDir); !errors.Is(err, store.ErrComparatorMismatch) {
+		t.Errorf("expected ErrComparatorMismatch, got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	for name, newMemtable := range map[string]func(comparator.Comparator) memtable.Memtable{
+		"avl":      memtable.NewAVL,
+		"skiplist": memtable.NewSkiplist,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := setup(t)
+			defer teardown(t, tmpDir)
+
+			db, err := New(tmpDir, WithMemtable(newMemtable))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			db.Set("a", "1")
+			db.Flush()
+			db.Set("b", "1")
+			db.Set("c", "1")
+
+			snap := db.Snapshot()
+			dbIt, err := db.NewIterator(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Set("a", "2")
+			db.Delete("b")
+			db.Set("d", "2")
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.MergeAll(); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, k := range []string{"a", "b", "c"} {
+				if val, found, err := snap.GetBytes([]byte(k)); err != nil || !found || string(val) != "1" {
+					t.Errorf("snapshot GetBytes(%v): %q, %v, %v", k, val, found, err)
+				}
+			}
+			if _, found, _ := snap.GetBytes([]byte("d")); found {
+				t.Errorf("key written after the snapshot is visible")
+			}
+
+			it, err := snap.NewIterator(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := snap.Release(); err != nil {
+				t.Fatal(err)
+			}
+			// neither the snapshot nor the DB iterator see the later writes
+			for _, it := range []*Iterator{it, dbIt} {
+				var keys []string
+				for it.Next() {
+					keys = append(keys, string(it.Key())+"="+string(it.Value()))
+				}
+				if err := it.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if strings.Join(keys, ",") != "a=1,b=1,c=1" {
+					t.Errorf("unexpected snapshot content: %v", keys)
+				}
+			}
+
+			if v := db.Get("a"); v != "2" {
+				t.Errorf("unexpected value: %q", v)
+			}
+		})
+	}
+}
+
+func TestTxn(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Set("x", "1")
+	db.Set("y", "1")
+
+	// read-modify-write without interference
+	txn := db.BeginTxn()
+	val, _, err := txn.GetBytes([]byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Put([]byte("x"), append(val, '1'))
+	txn.Put([]byte("z"), []byte("new"))
+	txn.Delete([]byte("y"))
+	if val, found, _ := txn.GetBytes([]byte("x")); !found || string(val) != "11" {
+		t.Errorf("transaction doesn't see its own write: %q", val)
+	}
+	if v := db.Get("z"); v != "" {
+		t.Errorf("uncommitted write is visible: %q", v)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Errorf("expected ErrTxnDone, got %v", err)
+	}
+
+	// a key read is modified by another writer
+	txn1 := db.BeginTxn()
+	txn2 := db.BeginTxn()
+	txn1.GetBytes([]byte("x"))
+	txn1.Put([]byte("w"), []byte("1"))
+	txn2.Put([]byte("x"), []byte("2"))
+	if err := txn2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn1.Commit(); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	if v := db.Get("w"); v != "" {
+		t.Errorf("write of the aborted transaction is visible: %q", v)
+	}
+
+	// blind writes on the same key conflict too
+	txn1 = db.BeginTxn()
+	db.Set("z", "other")
+	txn1.Put([]byte("z"), []byte("txn"))
+	if err := txn1.Commit(); err != ErrConflict {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+
+	// writes made before the transaction began don't conflict
+	db.Set("x", "3")
+	txn1 = db.BeginTxn()
+	txn1.GetBytes([]byte("x"))
+	txn1.Put([]byte("x"), []byte("4"))
+	if err := txn1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	txn1 = db.BeginTxn()
+	txn1.Put([]byte("x"), []byte("rolled back"))
+	txn1.Rollback()
+	txn1.Rollback()
+	if db.txns != 0 || db.lastWrite != nil {
+		t.Errorf("transactions still tracked: %v, %v", db.txns, db.lastWrite)
+	}
+
+	db.Close()
+
+	// committed transactions are replayed from the WAL
+	db, err = New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for k, exp := range map[string]string{"x": "4", "y": "", "z": "other", "w": ""} {
+		if v := db.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("a", "1")
+	txn := db.BeginTxn()
+	txn.Put([]byte("b"), []byte("2"))
+	txn.Put([]byte("c"), []byte("3"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// simulate a crash in the middle of a commit
+	walpath := filepath.Join(tmpDir, walFilename)
+	wal, err := os.ReadFile(walpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(walpath, wal[:len(wal)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for k, exp := range map[string]string{"a": "1", "b": "", "c": ""} {
+		if v := db.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+}
+
+func TestPessimisticTxn(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithLockTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// concurrent increments: readers upgrading their shared lock
+	// deadlock, one of them must be aborted and retried
+	const workers, increments = 4, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				err := increment(db, []byte("counter"))
+				if err == ErrDeadlock {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if v := db.Get("counter"); v != strconv.Itoa(workers*increments) {
+		t.Errorf("unexpected counter value: %v", v)
+	}
+
+	// crossed exclusive locks
+	txn1 := db.BeginPessimisticTxn()
+	txn2 := db.BeginPessimisticTxn()
+	if err := txn1.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn2.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	res := make(chan error, 2)
+	for _, tc := range []struct {
+		txn *Txn
+		key string
+	}{{txn1, "b"}, {txn2, "a"}} {
+		go func(txn *Txn, key string) {
+			err := txn.Put([]byte(key), []byte("x"))
+			if err == nil {
+				err = txn.Commit()
+			}
+			txn.Rollback()
+			res <- err
+		}(tc.txn, tc.key)
+	}
+	var deadlocks int
+	for i := 0; i < 2; i++ {
+		if err := <-res; err == ErrDeadlock {
+			deadlocks++
+		} else if err != nil {
+			t.Error(err)
+		}
+	}
+	if deadlocks != 1 {
+		t.Errorf("expected one deadlock, got %v", deadlocks)
+	}
+}
+
+func increment(db *DB, key []byte) error {
+	txn := db.BeginPessimisticTxn()
+	defer txn.Rollback()
+
+	val, _, err := txn.GetBytes(key)
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.Atoi(string(val))
+	if err := txn.Put(key, []byte(strconv.Itoa(n+1))); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+func TestLockTimeout(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithLockTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	txn := db.BeginPessimisticTxn()
+	if _, _, err := txn.GetBytes([]byte("k")); err != nil {
+		t.Fatal(err)
+	}
+
+	// writers wait for the transaction, readers don't
+	if err := db.Set("k", "v"); err != ErrLockTimeout {
+		t.Errorf("expected ErrLockTimeout, got %v", err)
+	}
+	opt := db.BeginTxn()
+	opt.Put([]byte("k"), []byte("v"))
+	if err := opt.Commit(); err != ErrLockTimeout {
+		t.Errorf("expected ErrLockTimeout, got %v", err)
+	}
+	if v := db.Get("k"); v != "" {
+		t.Errorf("unexpected value: %q", v)
+	}
+
+	txn.Rollback()
+	if err := db.Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.locks.locks) != 0 || len(db.locks.waitsFor) != 0 {
+		t.Errorf("locks not released: %v, %v", db.locks.locks, db.locks.waitsFor)
+	}
+}
+
+func TestDeleteRangeLocks(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithLockTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("b", "1")
+	txn := db.BeginPessimisticTxn()
+	read := func() {
+		t.Helper()
+		if v, found, err := txn.GetBytes([]byte("b")); err != nil || !found || string(v) != "1" {
+			t.Errorf("read not repeatable: %q, %v, %v", v, found, err)
+		}
+	}
+	read()
+
+	// the range deletion waits for the transaction
+	if err := db.DeleteRange([]byte("a"), []byte("c")); err != ErrLockTimeout {
+		t.Errorf("expected ErrLockTimeout, got %v", err)
+	}
+	read()
+	if err := db.DeleteRange([]byte("c"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys of the range can't be locked while it is deleted
+	owner := db.newOwner()
+	r := store.RangeTombstone{Start: []byte("x"), End: []byte("z")}
+	if err := db.locks.acquireRange(owner, r, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := txn.GetBytes([]byte("y")); err != ErrLockTimeout {
+		t.Errorf("expected ErrLockTimeout, got %v", err)
+	}
+	db.locks.releaseRange(owner)
+	if _, _, err := txn.GetBytes([]byte("y")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn.Rollback()
+	if err := db.DeleteRange([]byte("a"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get("b"); v != "" {
+		t.Errorf("unexpected value: %q", v)
+	}
+	if len(db.locks.locks) != 0 || len(db.locks.ranges) != 0 || len(db.locks.waitsFor) != 0 {
+		t.Errorf("locks not released: %v, %v, %v", db.locks.locks, db.locks.ranges, db.locks.waitsFor)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	check := func(ok bool, err error, exp bool) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != exp {
+			t.Errorf("condition returned %v, expected %v", ok, exp)
+		}
+	}
+
+	k := []byte("k")
+	ok, err := db.PutIfAbsent(k, []byte("1"))
+	check(ok, err, true)
+	ok, err = db.PutIfAbsent(k, []byte("2"))
+	check(ok, err, false)
+
+	// the current value may be in an sstable
+	db.Flush()
+	ok, err = db.CompareAndSwap(k, []byte("2"), []byte("3"))
+	check(ok, err, false)
+	ok, err = db.CompareAndSwap(k, []byte("1"), []byte("3"))
+	check(ok, err, true)
+	if v := db.Get("k"); v != "3" {
+		t.Errorf("unexpected value: %q", v)
+	}
+
+	ok, err = db.DeleteIfEquals(k, []byte("1"))
+	check(ok, err, false)
+	ok, err = db.DeleteIfEquals(k, []byte("3"))
+	check(ok, err, true)
+	ok, err = db.CompareAndSwap(k, nil, []byte("4"))
+	check(ok, err, true)
+
+	// concurrent increments never lose an update
+	db.Set("counter", "0")
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; {
+				cur := db.Get("counter")
+				n, _ := strconv.Atoi(cur)
+				ok, err := db.CompareAndSwap([]byte("counter"), []byte(cur), []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if v := db.Get("counter"); v != "400" {
+		t.Errorf("unexpected counter value: %v", v)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithMergeOperator(merge.Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(key string, n int) {
+		t.Helper()
+		if err := db.Merge([]byte(key), []byte(strconv.Itoa(n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(exp map[string]string) {
+		t.Helper()
+		for k, v := range exp {
+			if got := db.Get(k); got != v {
+				t.Errorf("unexpected value for %v: %q != %q", k, got, v)
+			}
+		}
+
+		var keys []string
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+			if v := string(it.Value()); v != exp[string(it.Key())] {
+				t.Errorf("unexpected iterator value for %s: %q", it.Key(), v)
+			}
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != len(exp) {
+			t.Errorf("unexpected keys: %v", keys)
+		}
+	}
+
+	db.Set("a", "10")
+	add("a", 1)
+	add("b", 1)
+	db.Flush()
+	add("a", 2)
+	add("b", 2)
+	db.Delete("c")
+	db.Flush()
+	add("a", 3)
+	add("b", 3)
+	add("c", 5)
+
+	snap := db.Snapshot()
+	check(map[string]string{"a": "16", "b": "6", "c": "5"})
+
+	// operands written in the memtable are stacked, then applied
+	// by compactions
+	add("b", 4)
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	db.Flush()
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]string{"a": "16", "b": "10", "c": "5"})
+
+	if v, _, _ := snap.GetBytes([]byte("b")); string(v) != "6" {
+		t.Errorf("unexpected snapshot value: %q", v)
+	}
+	snap.Release()
+
+	add("a", 1)
+	add("d", -1)
+	db.Close()
+
+	// operands are replayed from the WAL
+	db, err = New(tmpDir, WithMergeOperator(merge.Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]string{"a": "17", "b": "10", "c": "5", "d": "-1"})
+	// operands are only checked when read
+	if err := db.Merge([]byte("f"), []byte("not a number")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.GetBytes([]byte("f")); err == nil {
+		t.Errorf("invalid operand should fail")
+	}
+	db.Delete("f")
+	add("e", 1)
+	db.Close()
+
+	db, err = New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Merge([]byte("a"), []byte("1")); !errors.Is(err, store.ErrNoMergeOperator) {
+		t.Errorf("expected ErrNoMergeOperator, got %v", err)
+	}
+	if _, _, err := db.GetBytes([]byte("e")); !errors.Is(err, store.ErrNoMergeOperator) {
+		t.Errorf("expected ErrNoMergeOperator, got %v", err)
+	}
+}
+
+func TestMergeFailure(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithMergeOperator(merge.Int64Add))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// the value is in a table for c, in the memtable for m
+	db.Set("c", "hello")
+	db.Flush()
+	db.Set("m", "hello")
+	for _, k := range []string{"c", "m", "n"} {
+		if err := db.Merge([]byte(k), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(step string) {
+		t.Helper()
+		for _, k := range []string{"c", "m"} {
+			var merr *store.MergeError
+			if _, _, err := db.GetBytes([]byte(k)); !errors.As(err, &merr) {
+				t.Errorf("%v: expected a MergeError for %v, got %v", step, k, err)
+			}
+			if v := db.Get(k); v != "" {
+				t.Errorf("%v: unexpected value for %v: %q", step, k, v)
+			}
+		}
+		if v := db.Get("n"); v != "1" {
+			t.Errorf("%v: unexpected value for n: %q", step, v)
+		}
+	}
+	check("memtable")
+
+	// the operands are kept, they don't block the compactions
+	db.Flush()
+	for i := 0; i < 2; i++ {
+		if err := db.MergeAll(); err != nil {
+			t.Fatal(err)
+		}
+		check("compacted")
+	}
+
+	db.Close()
+	if db, err = New(tmpDir, WithMergeOperator(merge.Int64Add)); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened")
+
+	db.Set("c", "5")
+	db.Merge([]byte("c"), []byte("1"))
+	if v := db.Get("c"); v != "6" {
+		t.Errorf("unexpected value for c: %q", v)
+	}
+}
+
+func TestReplayWithoutMergeOperator(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	op := WithMergeOperator(merge.StringAppend(","))
+	db, err := New(tmpDir, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("plain", "v")
+	db.Set("k", "a")
+	db.Merge([]byte("k"), []byte("b"))
+	db.Close()
+
+	// the WAL can't be replayed, it must be kept as is
+	if _, err := New(tmpDir); !errors.Is(err, store.ErrNoMergeOperator) {
+		t.Fatalf("expected ErrNoMergeOperator, got %v", err)
+	}
+
+	if db, err = New(tmpDir, op); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for k, exp := range map[string]string{"plain": "v", "k": "a,b"} {
+		if v := db.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+}
+
+func TestReplayAfterFlush(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	op := WithMergeOperator(merge.StringAppend(","))
+	db, err := New(tmpDir, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Set("plain", "v")
+	db.Merge([]byte("k"), []byte("a"))
+	db.Merge([]byte("k"), []byte("b"))
+
+	walpath := filepath.Join(tmpDir, walFilename)
+	wal, err := os.ReadFile(walpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// simulate a crash after the memtable was written but before the
+	// WAL was rotated: its writes are already in the sstable
+	if err := os.WriteFile(walpath, wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = New(tmpDir, op); err != nil {
+		t.Fatal(err)
+	}
+	for k, exp := range map[string]string{"plain": "v", "k": "a,b"} {
+		if v := db.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+	seq := db.LastSeq()
+	db.Set("other", "w")
+	db.Close()
+
+	// the sequence numbers keep increasing after the skipped writes
+	if db, err = New(tmpDir, op); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if last := db.LastSeq(); last != seq+1 {
+		t.Errorf("unexpected last seq: %v != %v", last, seq+1)
+	}
+	if v := db.Get("other"); v != "w" {
+		t.Errorf("unexpected value for other: %q", v)
+	}
+}
+
+func TestMergeOperators(t *testing.T) {
+	for _, tc := range []struct {
+		op       merge.Operator
+		operands []string
+		exp      string
+		// after writing z then merging y
+		expOnValue string
+	}{
+		{merge.StringAppend(","), []string{"a", "b", "c"}, "a,b,c", "z,y"},
+		{merge.Max, []string{"b", "c", "a"}, "c", "z"},
+	} {
+		tmpDir := setup(t)
+		defer teardown(t, tmpDir)
+
+		db, err := New(tmpDir, WithMergeOperator(tc.op))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, o := range tc.operands {
+			db.Merge([]byte("k"), []byte(o))
+			db.Flush()
+		}
+		if v := db.Get("k"); v != tc.exp {
+			t.Errorf("unexpected value: %q != %q", v, tc.exp)
+		}
+
+		db.Set("k", "z")
+		db.Merge([]byte("k"), []byte("y"))
+		if v := db.Get("k"); v != tc.expOnValue {
+			t.Errorf("unexpected value: %q != %q", v, tc.expOnValue)
+		}
+	}
+}
+
+func TestLegacyFormats(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	writeFile := func(name string, magic uint64, kvs ...string) {
+		t.Helper()
+		var buf bytes.Buffer
+		if magic != 0 {
+			binary.Write(&buf, binary.LittleEndian, magic)
+		}
+		for _, kv := range kvs {
+			binary.Write(&buf, binary.LittleEndian, uint64(len(kv)))
+			buf.WriteString(kv)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// table and WAL written before the comparators and the kind bytes
+	writeFile("data_0001.sst", 0x7473732d696e696d, "a", "1", "b", "1", "c", "1")
+	writeFile(walFilename, 0, "c", "3", "d", "3")
+	// with a current table on top
+	var tree avl.Tree
+	tree.Upsert([]byte("a"), store.NewValue([]byte("2")))
+	tree.Upsert([]byte("b"), nil)
+	if err := store.WriteFile(filepath.Join(tmpDir, "data_0002.sst"), comparator.Bytewise, tree.Iterator(), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := New(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for k, exp := range map[string]string{"a": "2", "b": "", "c": "3", "d": "3"} {
+		if v := db.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if v := db.Get("a"); v != "2" {
+		t.Errorf("unexpected value after merge: %q", v)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	db, err := New(tmpDir, WithClock(clock), WithMergeOperator(merge.StringAppend(",")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("a", "old")
+	db.Set("b", "forever")
+	db.Flush()
+	db.SetWithTTL("a", "session", time.Minute)
+	db.SetWithTTL("c", "short", time.Second)
+	db.Flush()
+	db.Merge([]byte("a"), []byte("more"))
+	db.Set("d", "forever")
+
+	keys := func() string {
+		t.Helper()
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		return strings.Join(keys, ",")
+	}
+
+	if k := keys(); k != "a=session,more,b=forever,c=short,d=forever" {
+		t.Errorf("unexpected keys: %v", k)
+	}
+
+	now = now.Add(2 * time.Second)
+	if v := db.Get("c"); v != "" {
+		t.Errorf("expired key is visible: %q", v)
+	}
+	if ok, err := db.PutIfAbsent([]byte("c"), []byte("new")); err != nil || !ok {
+		t.Errorf("expired key should be absent: %v, %v", ok, err)
+	}
+	db.Delete("c")
+
+	// merge operands on top of an expired value apply to a deleted key
+	now = now.Add(time.Minute)
+	if k := keys(); k != "a=more,b=forever,d=forever" {
+		t.Errorf("unexpected keys: %v", k)
+	}
+
+	// compaction drops expired values for good,
+	// the old value of a must not come back
+	db.Flush()
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if k := keys(); k != "a=more,b=forever,d=forever" {
+		t.Errorf("unexpected keys after compaction: %v", k)
+	}
+
+	it, err := db.store[0].NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var stored []string
+	for it.First(); it.Valid(); it.Next() {
+		stored = append(stored, string(it.Key()))
+	}
+	if strings.Join(stored, ",") != "a,b,c,d" {
+		t.Errorf("unexpected keys in the table: %v", stored)
+	}
+}
+
+func TestMergeOnExpiredValue(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	db, err := New(tmpDir, WithClock(clock), WithMergeOperator(merge.StringAppend(",")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the expired value is in a table for t, in the memtable for m
+	db.SetWithTTL("t", "old", time.Second)
+	db.Flush()
+	db.SetWithTTL("m", "old", time.Second)
+
+	now = now.Add(2 * time.Second)
+	db.Merge([]byte("t"), []byte("new"))
+	db.Merge([]byte("m"), []byte("new"))
+
+	check := func(step string) {
+		t.Helper()
+		for _, k := range []string{"m", "t"} {
+			if v := db.Get(k); v != "new" {
+				t.Errorf("%v: unexpected value for %v: %q", step, k, v)
+			}
+		}
+		values, found, err := db.MultiGet([][]byte{[]byte("m"), []byte("t")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range values {
+			if !found[i] || string(v) != "new" {
+				t.Errorf("%v: unexpected MultiGet value %v: %q, %v", step, i, v, found[i])
+			}
+		}
+
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		if k := strings.Join(keys, ","); k != "m=new,t=new" {
+			t.Errorf("%v: unexpected keys: %v", step, k)
+		}
+	}
+	check("memtable")
+
+	db.Flush()
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	check("compaction")
+
+	// the expiry of the old values isn't copied on the result
+	now = now.Add(time.Hour)
+	check("later")
+}
+
+func TestMergeOnExpiringValue(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	opts := []Option{WithClock(clock), WithMergeOperator(merge.StringAppend(","))}
+
+	db, err := New(tmpDir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	// the value is in a table for f, in the memtable for m
+	db.SetWithTTL("f", "1", time.Second)
+	db.Flush()
+	db.SetWithTTL("m", "1", time.Second)
+	db.Merge([]byte("f"), []byte("x"))
+	db.Merge([]byte("m"), []byte("x"))
+
+	check := func(step, exp string) {
+		t.Helper()
+		for _, k := range []string{"f", "m"} {
+			if v, found, err := db.GetBytes([]byte(k)); err != nil || !found || string(v) != exp {
+				t.Errorf("%v: unexpected value for %v: %q, %v, %v", step, k, v, found, err)
+			}
+		}
+	}
+	reopen := func() {
+		t.Helper()
+		db.Close()
+		if db, err = New(tmpDir, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check("before expiry", "1,x")
+	reopen()
+	check("replayed before expiry", "1,x")
+	db.Flush()
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted before expiry", "1,x")
+
+	// the operands outlive the value, whether it was flushed or not
+	now = now.Add(2 * time.Second)
+	check("after expiry", "x")
+	reopen()
+	check("replayed after expiry", "x")
+
+	db.Flush()
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	check("compacted", "x")
+}
+
+type tenantFilter struct{}
+
+func (tenantFilter) Filter(key, value []byte) (store.FilterDecision, []byte) {
+	switch {
+	case bytes.HasPrefix(key, []byte("deleted/")):
+		return store.FilterRemove, nil
+	case bytes.HasPrefix(key, []byte("upper/")):
+		return store.FilterChange, bytes.ToUpper(value)
+	}
+	return store.FilterKeep, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithCompactionFilter(tenantFilter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("deleted/a", "old")
+	db.Flush()
+	db.Set("deleted/a", "new")
+	db.Set("deleted/b", "new")
+	db.Set("keep", "value")
+	db.Flush()
+	db.SetWithTTL("upper/a", "value", time.Hour)
+	db.Delete("keep2")
+	db.Flush()
+
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, exp := range map[string]string{"deleted/a": "", "deleted/b": "", "keep": "value", "upper/a": "VALUE"} {
+		if v := db.Get(k); v != exp {
+			t.Errorf("unexpected value for %v: %q != %q", k, v, exp)
+		}
+	}
+
+	// the first compaction replaces the removed values by deletions,
+	// which are not filtered and shadow deleted/a in the second one
+	exp := store.CompactionStats{
+		Compactions: 2,
+		Read:        11,
+		Written:     10,
+		Kept:        2,
+		Removed:     2,
+		Changed:     2,
+	}
+	if stats := db.CompactionStats(); stats != exp {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	opts := []Option{WithMergeOperator(merge.StringAppend(","))}
+	db, err := New(tmpDir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	key := func(i int) string { return fmt.Sprintf("k%02d", i) }
+	exp := make(map[string]string)
+
+	// k00-k29 in a table, k20-k39 in the memtable
+	for i := 0; i < 30; i++ {
+		db.Set(key(i), "old")
+		exp[key(i)] = "old"
+	}
+	db.Flush()
+	for i := 20; i < 40; i++ {
+		db.Set(key(i), "new")
+		exp[key(i)] = "new"
+	}
+
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	if err := db.DeleteRange([]byte(key(10)), []byte(key(25))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < 25; i++ {
+		delete(exp, key(i))
+	}
+	// writes after the range tombstone are visible
+	db.Set(key(12), "after")
+	db.Merge([]byte(key(14)), []byte("op"))
+	exp[key(12)] = "after"
+	exp[key(14)] = "op"
+
+	check := func(when string) {
+		t.Helper()
+		for i := 0; i < 40; i++ {
+			if v := db.Get(key(i)); v != exp[key(i)] {
+				t.Errorf("%s: unexpected value for %v: %q != %q", when, key(i), v, exp[key(i)])
+			}
+		}
+
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		var n int
+		for it.Next() {
+			if v, ok := exp[string(it.Key())]; !ok || v != string(it.Value()) {
+				t.Errorf("%s: unexpected key %s: %s", when, it.Key(), it.Value())
+			}
+			n++
+		}
+		if it.Err() != nil || n != len(exp) {
+			t.Errorf("%s: iterated over %v keys, expected %v: %v", when, n, len(exp), it.Err())
+		}
+	}
+	check("memtable")
+
+	if v, _, _ := snap.GetBytes([]byte(key(15))); string(v) != "old" {
+		t.Errorf("unexpected value in snapshot: %q", v)
+	}
+	if v, _, _ := snap.GetBytes([]byte(key(22))); string(v) != "new" {
+		t.Errorf("unexpected value in snapshot: %q", v)
+	}
+
+	// replayed from the WAL
+	db.Close()
+	if db, err = New(tmpDir, opts...); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened")
+
+	// a transaction reading a deleted key conflicts
+	txn := db.BeginTxn()
+	txn.GetBytes([]byte(key(36)))
+	txn.Put([]byte("x"), []byte("x"))
+
+	// without upper bound, stored in a table without keys
+	if err := db.DeleteRange([]byte(key(35)), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 35; i < 40; i++ {
+		delete(exp, key(i))
+	}
+	if err := txn.Commit(); err != ErrConflict {
+		t.Errorf("unexpected commit result: %v", err)
+	}
+	db.Flush()
+	check("flushed")
+
+	if err := db.MergeAll(); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted")
+
+	// k35-k39 of the memtable then k10-k24 of the first table,
+	// except the keys written again
+	if stats := db.CompactionStats(); stats.Covered != 13 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithMergeOperator(merge.StringAppend(",")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key_%03d", i)) }
+
+	for table := 0; table < 3; table++ {
+		for i := 0; i < 200; i++ {
+			k := key(rand.Intn(300))
+			switch rand.Intn(10) {
+			case 0:
+				db.Delete(string(k))
+			case 1, 2:
+				db.Merge(k, []byte(strconv.Itoa(i)))
+			default:
+				db.Put(k, []byte(strconv.Itoa(i)))
+			}
+		}
+		db.Flush()
+	}
+	db.DeleteRange(key(100), key(120))
+	for i := 0; i < 50; i++ {
+		db.Put(key(rand.Intn(300)), []byte("mem"))
+	}
+
+	// unsorted, with duplicates and missing keys
+	var keys [][]byte
+	for i := 0; i < 400; i++ {
+		keys = append(keys, key(rand.Intn(350)))
+	}
+
+	values, found, err := db.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(keys) || len(found) != len(keys) {
+		t.Fatalf("unexpected result length: %v, %v", len(values), len(found))
+	}
+	for i, k := range keys {
+		val, ok, err := db.GetBytes(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != found[i] || !bytes.Equal(val, values[i]) {
+			t.Errorf("unexpected value for %s: %q, %v != %q, %v", k, values[i], found[i], val, ok)
+		}
+	}
+
+	if values, found, err := db.MultiGet(nil); err != nil || len(values) != 0 || len(found) != 0 {
+		t.Errorf("unexpected result without keys: %v, %v, %v", values, found, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	opts := []Option{WithWALRetention(2), WithMergeOperator(merge.StringAppend(","))}
+	db, err := New(tmpDir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	check := func(w *Watcher, exp ...string) {
+		t.Helper()
+		for _, e := range exp {
+			if !w.Next() {
+				t.Fatalf("missing change %q: %v", e, w.Err())
+			}
+			c := w.Change()
+			if s := fmt.Sprintf("%d %d %s=%s %s", c.Seq, c.Kind, c.Key, c.Value, c.End); s != e {
+				t.Errorf("unexpected change: %q != %q", s, e)
+			}
+		}
+	}
+
+	db.Set("a/1", "1")
+	db.Set("b/1", "1")
+	db.Flush()
+	db.SetWithTTL("a/2", "2", time.Hour)
+	db.Merge([]byte("a/3"), []byte("x"))
+	db.Merge([]byte("a/3"), []byte("y"))
+	db.Delete("a/1")
+	db.DeleteRange([]byte("a/5"), []byte("a/9"))
+	db.Flush()
+	db.Set("a/4", "4")
+
+	w, err := db.Watch([]byte("a/"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// read from the WAL segments and the current WAL
+	check(w, "1 0 a/1=1 ", "3 0 a/2=2 ")
+	if w.Change().Expiry.IsZero() {
+		t.Errorf("missing expiry")
+	}
+	check(w, "4 2 a/3=x ", "5 2 a/3=y ", "6 1 a/1= ", "7 3 a/5= a/9", "8 0 a/4=4 ")
+
+	// written after Watch
+	db.Merge([]byte("a/3"), []byte("z"))
+	db.Set("b/2", "2")
+	db.DeleteRange([]byte("a/8"), nil)
+	db.Merge([]byte("a/3"), []byte("w"))
+	check(w, "9 2 a/3=z ", "11 3 a/8= ", "12 2 a/3=w ")
+	w.Close()
+
+	// resume after a restart
+	db.Close()
+	if db, err = New(tmpDir, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if seq := db.LastSeq(); seq != 12 {
+		t.Errorf("unexpected last seq: %v", seq)
+	}
+	if v := db.Get("a/3"); v != "x,y,z,w" {
+		t.Errorf("unexpected value after replay: %q", v)
+	}
+
+	w, err = db.Watch([]byte("a/"), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	check(w, "8 0 a/4=4 ", "9 2 a/3=z ", "11 3 a/8= ", "12 2 a/3=w ")
+
+	// the first segment is past the retention
+	if _, err := db.Watch([]byte("a/"), 0); err != ErrChangesTruncated {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Close stops a waiting Next
+	live, err := db.Watch(nil, db.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, done := make(chan bool), make(chan bool)
+	go func() {
+		got <- live.Next()
+		done <- live.Next()
+	}()
+	db.Set("c", "1")
+	if !<-got {
+		t.Fatalf("missing live change: %v", live.Err())
+	}
+	if c := live.Change(); c.Seq != 13 || string(c.Key) != "c" {
+		t.Errorf("unexpected live change: %+v", c)
+	}
+	live.Close()
+	if <-done {
+		t.Errorf("Next should stop once closed")
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	tmpDir := setup(t)
+	defer teardown(t, tmpDir)
+
+	db, err := New(tmpDir, WithWatchBuffer(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Set("a", "0")
+	w, err := db.Watch(nil, db.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the consumer is stalled while the changes are written
+	for i := 1; i <= 4; i++ {
+		db.Set("a", strconv.Itoa(i))
+	}
+	var seqs []uint64
+	for w.Next() {
+		seqs = append(seqs, w.Change().Seq)
+	}
+	var oerr *OverflowError
+	if !errors.As(w.Err(), &oerr) || oerr.Seq != 3 {
+		t.Fatalf("expected an OverflowError after change 3, got %v", w.Err())
+	}
+	if fmt.Sprint(seqs) != "[2 3]" {
+		t.Errorf("unexpected changes: %v", seqs)
+	}
+
+	// the changes are resumed from the WAL
+	w2, err := db.Watch(nil, oerr.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	for _, exp := range []string{"4", "5"} {
+		if !w2.Next() {
+			t.Fatalf("missing change: %v", w2.Err())
+		}
+		if c := w2.Change(); fmt.Sprint(c.Seq) != exp {
+			t.Errorf("unexpected change: %+v", c)
+		}
+	}
+}
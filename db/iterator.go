@@ -0,0 +1,192 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jrouviere/minikv/comparator"
+	"github.com/jrouviere/minikv/memtable"
+	"github.com/jrouviere/minikv/merge"
+	"github.com/jrouviere/minikv/store"
+)
+
+// source is implemented by memtable and sstable iterators
+type source interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next()
+}
+
+// Iterator walks the keys of the DB in order, merging the memtable and
+// all the sstables. Deleted and expired keys are skipped. It must be closed
+// after use.
+//
+// The slices returned by Key and Value are only valid until the next
+// call to Next and must not be modified, copy them to keep them longer.
+type Iterator struct {
+	cmp comparator.Comparator
+	op  merge.Operator
+	now func() time.Time
+	// newest first, with the range tombstones of each source
+	sources   []source
+	rangeDels [][]store.RangeTombstone
+	tables    []*store.TableIterator
+	pinned    []*store.SSTable
+
+	end        []byte
+	key, value []byte
+	err        error
+}
+
+// NewIterator returns an iterator over the keys in [start, end),
+// a nil start or end means no lower or upper bound, as they are when
+// NewIterator is called. Next must be called to move to the first key.
+func (db *DB) NewIterator(start, end []byte) (*Iterator, error) {
+	db.mu.RLock()
+	mem := db.memtable.Snapshot().Iterator()
+	memDels := db.rangeDeletes()
+	pinned := ref(db.store)
+	db.mu.RUnlock()
+
+	return newIterator(&db.opts, mem, memDels, pinned, start, end)
+}
+
+// ref pins tables and returns a copy of the slice
+func ref(tables []*store.SSTable) []*store.SSTable {
+	pinned := make([]*store.SSTable, len(tables))
+	copy(pinned, tables)
+	for _, sst := range pinned {
+		sst.Ref()
+	}
+	return pinned
+}
+
+// newIterator takes ownership of the pinned tables,
+// memDels are the range tombstones of mem
+func newIterator(o *options, mem memtable.Iterator, memDels []store.RangeTombstone, pinned []*store.SSTable, start, end []byte) (*Iterator, error) {
+	it := &Iterator{
+		cmp:    o.cmp,
+		op:     o.mergeOperator,
+		now:    o.now,
+		pinned: pinned,
+		end:    clone(end),
+	}
+
+	if start == nil {
+		mem.First()
+	} else {
+		mem.Seek(start)
+	}
+	it.sources = append(it.sources, mem)
+	it.rangeDels = append(it.rangeDels, memDels)
+
+	for i := len(pinned) - 1; i >= 0; i-- {
+		tit, err := pinned[i].NewIterator()
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		if start == nil {
+			tit.First()
+		} else {
+			tit.Seek(start)
+		}
+		it.tables = append(it.tables, tit)
+		it.sources = append(it.sources, tit)
+		it.rangeDels = append(it.rangeDels, pinned[i].RangeTombstones())
+	}
+
+	return it, nil
+}
+
+// Next moves to the next key, it returns false once
+// there are no more keys or an error occurred.
+func (it *Iterator) Next() bool {
+	now := it.now()
+	for {
+		// find the smallest key, the newest source wins on ties
+		var cur source
+		for _, src := range it.sources {
+			if src.Valid() && (cur == nil || it.cmp.Compare(src.Key(), cur.Key()) < 0) {
+				cur = src
+			}
+		}
+
+		if cur == nil || (it.end != nil && it.cmp.Compare(cur.Key(), it.end) >= 0) {
+			it.key, it.value = nil, nil
+			return false
+		}
+
+		it.key = append(it.key[:0], cur.Key()...)
+
+		// older versions of the key are shadowed, unless the newer ones
+		// are merge operands, and a range tombstone hides the older sources
+		var value []byte
+		var found, covered bool
+		for i, src := range it.sources {
+			if src.Valid() && it.cmp.Compare(src.Key(), it.key) == 0 {
+				var err error
+				switch {
+				case covered:
+				case !found:
+					value, found = append(it.value[:0], src.Value()...), true
+				case store.IsOperand(value):
+					value, err = store.Combine(it.op, it.key, value, src.Value(), now)
+				}
+				if err != nil {
+					it.err = err
+					return false
+				}
+				src.Next()
+			}
+			covered = covered || store.Covered(it.cmp, it.rangeDels[i], it.key)
+		}
+
+		for _, tit := range it.tables {
+			if err := tit.Err(); err != nil {
+				it.err = err
+				return false
+			}
+		}
+
+		val, found, err := store.Resolve(it.op, it.key, value, now)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if found {
+			it.value = append(it.value[:0], val...)
+			return true
+		}
+	}
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the sstables pinned by the iterator
+func (it *Iterator) Close() error {
+	var err error
+	for _, tit := range it.tables {
+		if cerr := tit.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for _, sst := range it.pinned {
+		if uerr := sst.Unref(); err == nil {
+			err = uerr
+		}
+	}
+	it.tables, it.pinned, it.sources, it.rangeDels = nil, nil, nil, nil
+	return err
+}
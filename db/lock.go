@@ -0,0 +1,7 @@
+package db
+
+import "errors"
+
+// ErrLocked is returned when the data directory is already
+// in use by another process.
+var ErrLocked = errors.New("database directory is locked by another process")
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package db
+
+// dirLock is a no-op on platforms without flock, concurrent
+// processes are not detected there.
+type dirLock struct{}
+
+func lockDir(dirname string, exclusive bool) (*dirLock, error) {
+	return &dirLock{}, nil
+}
+
+func (l *dirLock) release() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dirLock is an advisory flock held on the data directory itself for as
+// long as the DB is open. The directory always exists, unlike a lock
+// file, so readers are locked even if no writer ever opened it.
+type dirLock struct {
+	file *os.File
+}
+
+// lockDir takes an exclusive lock for writers and a shared one for readers
+func lockDir(dirname string, exclusive bool) (*dirLock, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dirname)
+		}
+		return nil, err
+	}
+
+	return &dirLock{file: f}, nil
+}
+
+func (l *dirLock) release() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jrouviere/minikv/comparator"
+	"github.com/jrouviere/minikv/store"
+)
+
+var (
+	// ErrLockTimeout is returned when a key lock can't be acquired
+	// within the lock timeout.
+	ErrLockTimeout = errors.New("timeout waiting for key lock")
+	// ErrDeadlock is returned to the transaction whose lock request
+	// would close a cycle in the wait-for graph.
+	ErrDeadlock = errors.New("deadlock detected")
+)
+
+// lockManager hands out shared and exclusive locks on keys to owners
+// identified by a number: transactions, or single writes. Owners waiting
+// for a lock are recorded in a wait-for graph, a request that would make
+// the graph cyclic fails immediately instead of waiting forever.
+//
+// Range deletions take range locks, which exclude the locks of all the
+// keys they cover.
+type lockManager struct {
+	cmp      comparator.Comparator
+	mu       sync.Mutex
+	locks    map[string]*keyLock
+	ranges   []*rangeLock
+	waitsFor map[uint64][]uint64
+}
+
+type keyLock struct {
+	exclusive uint64 // owner of the exclusive lock, 0 if none
+	shared    map[uint64]struct{}
+	// released is closed, and replaced, when the lock is released
+	// to wake up the waiters
+	released chan struct{}
+}
+
+type rangeLock struct {
+	owner    uint64
+	r        store.RangeTombstone
+	released chan struct{}
+}
+
+func newLockManager(cmp comparator.Comparator) *lockManager {
+	return &lockManager{
+		cmp:      cmp,
+		locks:    make(map[string]*keyLock),
+		waitsFor: make(map[uint64][]uint64),
+	}
+}
+
+// holders returns the owners other than id preventing id from
+// taking the lock
+func (l *keyLock) holders(id uint64, exclusive bool) []uint64 {
+	if l.exclusive != 0 && l.exclusive != id {
+		return []uint64{l.exclusive}
+	}
+	if !exclusive {
+		return nil
+	}
+
+	var res []uint64
+	for owner := range l.shared {
+		if owner != id {
+			res = append(res, owner)
+		}
+	}
+	return res
+}
+
+// acquire takes a lock on key for id, a shared lock held by id
+// is upgraded when an exclusive lock is requested.
+func (lm *lockManager) acquire(id uint64, key string, exclusive bool, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		lm.mu.Lock()
+		blockers, released := lm.rangeHolders(id, key)
+		if len(blockers) == 0 {
+			l := lm.locks[key]
+			if l == nil {
+				l = &keyLock{
+					shared:   make(map[uint64]struct{}),
+					released: make(chan struct{}),
+				}
+				lm.locks[key] = l
+			}
+
+			blockers, released = l.holders(id, exclusive), l.released
+			if len(blockers) == 0 {
+				if exclusive {
+					l.exclusive = id
+					delete(l.shared, id)
+				} else if l.exclusive != id {
+					l.shared[id] = struct{}{}
+				}
+				delete(lm.waitsFor, id)
+				lm.mu.Unlock()
+				return nil
+			}
+		}
+
+		if err := lm.wait(id, blockers, released, timer); err != nil {
+			return err
+		}
+	}
+}
+
+// rangeHolders returns the owners other than id of the range locks
+// covering key, and a channel closed when one of them is released
+func (lm *lockManager) rangeHolders(id uint64, key string) ([]uint64, chan struct{}) {
+	for _, rl := range lm.ranges {
+		if rl.owner != id && rl.r.Covers(lm.cmp, []byte(key)) {
+			return []uint64{rl.owner}, rl.released
+		}
+	}
+	return nil, nil
+}
+
+// acquireRange takes a range lock on the keys of r for id, once the
+// locks held by other owners on these keys are released.
+func (lm *lockManager) acquireRange(id uint64, r store.RangeTombstone, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		lm.mu.Lock()
+		var blockers []uint64
+		var released chan struct{}
+		for key, l := range lm.locks {
+			if h := l.holders(id, true); len(h) > 0 && r.Covers(lm.cmp, []byte(key)) {
+				blockers, released = append(blockers, h...), l.released
+			}
+		}
+
+		if len(blockers) == 0 {
+			lm.ranges = append(lm.ranges, &rangeLock{owner: id, r: r, released: make(chan struct{})})
+			delete(lm.waitsFor, id)
+			lm.mu.Unlock()
+			return nil
+		}
+
+		if err := lm.wait(id, blockers, released, timer); err != nil {
+			return err
+		}
+	}
+}
+
+// wait records that id waits for blockers, until released is closed or
+// timer expires. lm.mu must be held, it is released.
+func (lm *lockManager) wait(id uint64, blockers []uint64, released chan struct{}, timer *time.Timer) error {
+	lm.waitsFor[id] = blockers
+	if lm.reaches(blockers, id, make(map[uint64]bool)) {
+		delete(lm.waitsFor, id)
+		lm.mu.Unlock()
+		return ErrDeadlock
+	}
+	lm.mu.Unlock()
+
+	select {
+	case <-released:
+		return nil
+	case <-timer.C:
+		lm.mu.Lock()
+		delete(lm.waitsFor, id)
+		lm.mu.Unlock()
+		return ErrLockTimeout
+	}
+}
+
+// reaches returns true if target can be reached from owners
+// by following the wait-for edges
+func (lm *lockManager) reaches(owners []uint64, target uint64, seen map[uint64]bool) bool {
+	for _, o := range owners {
+		if o == target {
+			return true
+		}
+		if seen[o] {
+			continue
+		}
+		seen[o] = true
+		if lm.reaches(lm.waitsFor[o], target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// release drops the locks held by id on keys
+func (lm *lockManager) release(id uint64, keys ...string) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	for _, key := range keys {
+		l := lm.locks[key]
+		if l == nil {
+			continue
+		}
+		if l.exclusive == id {
+			l.exclusive = 0
+		}
+		delete(l.shared, id)
+
+		close(l.released)
+		if l.exclusive == 0 && len(l.shared) == 0 {
+			delete(lm.locks, key)
+		} else {
+			l.released = make(chan struct{})
+		}
+	}
+}
+
+// releaseRange drops the range locks held by id
+func (lm *lockManager) releaseRange(id uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	ranges := lm.ranges[:0]
+	for _, rl := range lm.ranges {
+		if rl.owner == id {
+			close(rl.released)
+		} else {
+			ranges = append(ranges, rl)
+		}
+	}
+	lm.ranges = ranges
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"sort"
+
+	"github.com/jrouviere/minikv/memtable"
+	"github.com/jrouviere/minikv/store"
+)
+
+// MultiGet returns the values of keys in new buffers, in the same order
+// as keys, and whether each key was found. The keys are all read from
+// the same view of the DB, and each sstable is read once, in key order,
+// which is much faster than a GetBytes per key.
+func (db *DB) MultiGet(keys [][]byte) (values [][]byte, found []bool, err error) {
+	db.mu.RLock()
+	snap := db.snapshot()
+	db.mu.RUnlock()
+	defer snap.Release()
+
+	return snap.MultiGet(keys)
+}
+
+// MultiGet returns the values of keys as seen by the snapshot,
+// see DB.MultiGet.
+func (s *Snapshot) MultiGet(keys [][]byte) (values [][]byte, found []bool, err error) {
+	return s.opts.multiGet(s.mem, s.memDels, s.tables, keys)
+}
+
+// multiGet is get for many keys, going through the tables in key order
+func (o *options) multiGet(mem memtable.Reader, memDels []store.RangeTombstone, tables []*store.SSTable, keys [][]byte) ([][]byte, []bool, error) {
+	now := o.now()
+
+	lookups := make([]lookup, len(keys))
+	for i, key := range keys {
+		lookups[i] = o.lookup(mem, memDels, key, now)
+	}
+
+	sorted := make([]*lookup, len(keys))
+	for i := range lookups {
+		sorted[i] = &lookups[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return o.cmp.Compare(sorted[i].key, sorted[j].key) < 0
+	})
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		var pending []*lookup
+		var pendingKeys [][]byte
+		for _, l := range sorted {
+			if !l.done() {
+				pending = append(pending, l)
+				pendingKeys = append(pendingKeys, l.key)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		err := tables[i].GetSorted(pendingKeys, func(j int, value []byte) error {
+			return pending[j].add(o, clone(value))
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, l := range pending {
+			l.covered = store.Covered(o.cmp, tables[i].RangeTombstones(), l.key)
+		}
+	}
+
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	for i := range lookups {
+		val, ok, err := lookups[i].result(o)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i], found[i] = val, ok
+	}
+	return values, found, nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"time"
+
+	"github.com/jrouviere/minikv/comparator"
+	"github.com/jrouviere/minikv/memtable"
+	"github.com/jrouviere/minikv/merge"
+	"github.com/jrouviere/minikv/store"
+)
+
+// Option configures a DB in New and OpenReadOnly
+type Option func(*options)
+
+type options struct {
+	cmp            comparator.Comparator
+	newMemtable    func(cmp comparator.Comparator) memtable.Memtable
+	flushThreshold int64
+	memoryBudget   int64
+	lockTimeout    time.Duration
+	mergeOperator  merge.Operator
+	now            func() time.Time
+
+	compactionFilter store.CompactionFilter
+	walRetention     int
+	watchBuffer      int
+}
+
+func defaultOptions() options {
+	return options{
+		cmp:         comparator.Bytewise,
+		newMemtable: memtable.NewAVL,
+		lockTimeout: time.Second,
+		now:         time.Now,
+		watchBuffer: 10000,
+	}
+}
+
+// WithMemtable selects the memtable implementation,
+// the default is memtable.NewAVL.
+func WithMemtable(newMemtable func(cmp comparator.Comparator) memtable.Memtable) Option {
+	return func(o *options) {
+		o.newMemtable = newMemtable
+	}
+}
+
+// WithFlushThreshold flushes the memtable automatically once it uses
+// more than size bytes. By default the memtable is only flushed by Flush.
+func WithFlushThreshold(size int64) Option {
+	return func(o *options) {
+		o.flushThreshold = size
+	}
+}
+
+// WithMemoryBudget bounds the memory used by the memtable and the sstable
+// indexes: a write exceeding the budget flushes the memtable, stalling
+// other writers until it is done. Flushing doesn't reduce the indexes,
+// the memtable can always use a quarter of the budget, which is exceeded
+// once the indexes use more than the rest.
+func WithMemoryBudget(size int64) Option {
+	return func(o *options) {
+		o.memoryBudget = size
+	}
+}
+
+// WithComparator sets the ordering of the keys, the default is
+// comparator.Bytewise. A database must always be opened with the same
+// comparator, its name is checked against the one stored in the sstables.
+func WithComparator(cmp comparator.Comparator) Option {
+	return func(o *options) {
+		o.cmp = cmp
+	}
+}
+
+// WithLockTimeout sets how long writes and pessimistic transactions wait
+// for a key locked by another transaction before failing with
+// ErrLockTimeout, the default is one second.
+func WithLockTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.lockTimeout = d
+	}
+}
+
+// WithMergeOperator sets the operator combining the operands written
+// by DB.Merge. A database containing operands must always be opened
+// with an operator giving the same results.
+func WithMergeOperator(op merge.Operator) Option {
+	return func(o *options) {
+		o.mergeOperator = op
+	}
+}
+
+// WithClock replaces time.Now to decide when values written with
+// SetWithTTL expire.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithCompactionFilter calls filter for each value rewritten by MergeAll,
+// to remove or change values according to application rules.
+func WithCompactionFilter(filter store.CompactionFilter) Option {
+	return func(o *options) {
+		o.compactionFilter = filter
+	}
+}
+
+// WithWALRetention keeps the WAL of the last segments flushes on disk, so
+// that Watch can report the changes written before them. By default only
+// the changes written since the last flush can be watched.
+func WithWALRetention(segments int) Option {
+	return func(o *options) {
+		o.walRetention = segments
+	}
+}
+
+// WithWatchBuffer sets how many changes written since Watch a Watcher
+// buffers until Next returns them, the default is 10000. A Watcher whose
+// buffer is full stops with an OverflowError.
+func WithWatchBuffer(changes int) Option {
+	return func(o *options) {
+		o.watchBuffer = changes
+	}
+}
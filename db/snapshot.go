@@ -0,0 +1,61 @@
+package db
+
+import (
+	"github.com/jrouviere/minikv/memtable"
+	"github.com/jrouviere/minikv/store"
+)
+
+// Snapshot is a read-only view of the DB as it was when the snapshot
+// was taken, later writes, flushes and compactions are not visible.
+// The sstables it reads are kept on disk until Release is called.
+type Snapshot struct {
+	opts    *options
+	seq     uint64
+	mem     memtable.Reader
+	memDels []store.RangeTombstone
+	tables  []*store.SSTable
+}
+
+// Snapshot returns a snapshot of the DB, it must be released after use.
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.snapshot()
+}
+
+// snapshot must be called with db.mu held
+func (db *DB) snapshot() *Snapshot {
+	return &Snapshot{
+		opts:    &db.opts,
+		seq:     db.seq,
+		mem:     db.memtable.Snapshot(),
+		memDels: db.rangeDeletes(),
+		tables:  ref(db.store),
+	}
+}
+
+// GetBytes returns the value of key in a new buffer owned by the caller,
+// found is false if the key didn't exist or was deleted.
+func (s *Snapshot) GetBytes(key []byte) (val []byte, found bool, err error) {
+	return s.opts.get(s.mem, s.memDels, s.tables, key)
+}
+
+// NewIterator returns an iterator over the keys in [start, end) as seen
+// by the snapshot, it stays usable after the snapshot is released.
+func (s *Snapshot) NewIterator(start, end []byte) (*Iterator, error) {
+	return newIterator(s.opts, s.mem.Iterator(), s.memDels, ref(s.tables), start, end)
+}
+
+// Release unpins the sstables of the snapshot,
+// which must not be used afterwards.
+func (s *Snapshot) Release() error {
+	var err error
+	for _, sst := range s.tables {
+		if uerr := sst.Unref(); err == nil {
+			err = uerr
+		}
+	}
+	s.tables = nil
+	return err
+}
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/jrouviere/minikv/avl"
+	"github.com/jrouviere/minikv/store"
+)
+
+var (
+	// ErrConflict is returned by Commit when a key read or written by
+	// the transaction was modified since the transaction began.
+	ErrConflict = errors.New("transaction conflict")
+	// ErrTxnDone is returned when using a committed or rolled back transaction
+	ErrTxnDone = errors.New("transaction already committed or rolled back")
+)
+
+// Txn is a transaction, its writes are buffered until Commit which
+// applies them atomically, in a single WAL record. There are two modes:
+//
+// Optimistic transactions, started by BeginTxn, read from a snapshot
+// taken when they begin and lock nothing until Commit, which fails with
+// ErrConflict if another write changed one of the keys used in the
+// meantime.
+//
+// Pessimistic transactions, started by BeginPessimisticTxn, lock the
+// keys they use until they end: a shared lock for reads and an exclusive
+// one for writes. Reads see the latest committed values, and Commit
+// never conflicts. Taking a lock can fail with ErrLockTimeout or
+// ErrDeadlock, the transaction should then be rolled back.
+//
+// A Txn must not be used concurrently, and must be ended by Commit or
+// Rollback to release what it holds.
+type Txn struct {
+	db          *DB
+	id          uint64
+	pessimistic bool
+	writes      *avl.Tree
+	done        bool
+
+	// optimistic mode
+	snap  *Snapshot
+	reads map[string]struct{}
+
+	// pessimistic mode, true for exclusive locks
+	locks map[string]bool
+}
+
+func (db *DB) BeginTxn() *Txn {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.txns == 0 {
+		db.lastWrite = make(map[string]uint64)
+	}
+	db.txns++
+
+	return &Txn{
+		db:     db,
+		id:     db.newOwner(),
+		writes: avl.New(db.opts.cmp),
+		snap:   db.snapshot(),
+		reads:  make(map[string]struct{}),
+	}
+}
+
+func (db *DB) BeginPessimisticTxn() *Txn {
+	return &Txn{
+		db:          db,
+		id:          db.newOwner(),
+		pessimistic: true,
+		writes:      avl.New(db.opts.cmp),
+		locks:       make(map[string]bool),
+	}
+}
+
+// lock takes a lock on key for a pessimistic transaction
+func (t *Txn) lock(key string, exclusive bool) error {
+	if held, ok := t.locks[key]; ok && (held || !exclusive) {
+		return nil
+	}
+	if err := t.db.locks.acquire(t.id, key, exclusive, t.db.opts.lockTimeout); err != nil {
+		return err
+	}
+	t.locks[key] = exclusive
+	return nil
+}
+
+// GetBytes returns the value of key written by the transaction, or else
+// the value in the DB. The value is owned by the caller.
+func (t *Txn) GetBytes(key []byte) (val []byte, found bool, err error) {
+	if t.done {
+		return nil, false, ErrTxnDone
+	}
+	if val, found := t.writes.Get(key); found {
+		return clone(val), len(val) > 0, nil
+	}
+
+	if t.pessimistic {
+		if err := t.lock(string(key), false); err != nil {
+			return nil, false, err
+		}
+		return t.db.GetBytes(key)
+	}
+
+	t.reads[string(key)] = struct{}{}
+	return t.snap.GetBytes(key)
+}
+
+// Put buffers a write of value for key, an empty value deletes the key.
+// Like DB.Put, key and value can be reused once Put returns.
+func (t *Txn) Put(key, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.db.readOnly {
+		return ErrReadOnly
+	}
+	if t.pessimistic {
+		if err := t.lock(string(key), true); err != nil {
+			return err
+		}
+	}
+	t.writes.Upsert(clone(key), clone(value))
+	return nil
+}
+
+func (t *Txn) Delete(key []byte) error {
+	return t.Put(key, nil)
+}
+
+// Commit applies the writes of the transaction. An optimistic
+// transaction fails with ErrConflict if a key it read or wrote was
+// modified since BeginTxn, and nothing is written then.
+// The transaction is ended in all cases.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if t.pessimistic {
+		defer t.Rollback()
+		return t.db.writeBatch(t.batch())
+	}
+
+	db := t.db
+
+	// keys locked by pessimistic transactions can't be written
+	batch := t.batch()
+	locked := make([]string, 0, len(batch))
+	defer func() {
+		db.locks.release(t.id, locked...)
+	}()
+	for _, w := range batch {
+		if err := db.locks.acquire(t.id, string(w.Key), true, db.opts.lockTimeout); err != nil {
+			t.Rollback()
+			return err
+		}
+		locked = append(locked, string(w.Key))
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer db.endTxn(t)
+
+	for key := range t.reads {
+		if db.writtenSince(key, t.snap.seq) {
+			return ErrConflict
+		}
+	}
+	for _, w := range batch {
+		if db.writtenSince(string(w.Key), t.snap.seq) {
+			return ErrConflict
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return db.write(batch)
+}
+
+// rangeWrite is a range tombstone written while transactions are running
+type rangeWrite struct {
+	store.RangeTombstone
+	seq uint64
+}
+
+// writtenSince returns true if key was written or deleted by a range
+// tombstone after seq, db.mu must be held
+func (db *DB) writtenSince(key string, seq uint64) bool {
+	if db.lastWrite[key] > seq {
+		return true
+	}
+	for _, w := range db.rangeWrites {
+		if w.seq > seq && w.Covers(db.opts.cmp, []byte(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Txn) batch() []store.Write {
+	var batch []store.Write
+	t.writes.InorderTraversal(func(n *avl.Node) {
+		batch = append(batch, store.Write{Key: n.Key, Value: store.NewValue(n.Value)})
+	})
+	return batch
+}
+
+// writeBatch applies batch atomically, the caller holds the key locks
+func (db *DB) writeBatch(batch []store.Write) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.write(batch)
+}
+
+// Rollback discards the transaction, it is a no-op once the transaction
+// is committed so that it can be deferred.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+
+	if t.pessimistic {
+		t.done = true
+		keys := make([]string, 0, len(t.locks))
+		for key := range t.locks {
+			keys = append(keys, key)
+		}
+		t.db.locks.release(t.id, keys...)
+		return
+	}
+
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+
+	t.db.endTxn(t)
+}
+
+// endTxn ends an optimistic transaction, db.mu must be held
+func (db *DB) endTxn(t *Txn) {
+	t.done = true
+	t.snap.Release()
+
+	db.txns--
+	if db.txns == 0 {
+		db.lastWrite = nil
+		db.rangeWrites = nil
+	}
+}
@@ -0,0 +1,380 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jrouviere/minikv/store"
+)
+
+// ErrChangesTruncated is returned by Watch when the changes following the
+// requested sequence number are no longer retained, see WithWALRetention.
+var ErrChangesTruncated = errors.New("changes are no longer retained")
+
+// OverflowError stops a Watcher whose consumer doesn't keep up with the
+// writes, see WithWatchBuffer. Seq is the sequence number of the last
+// change returned by Next: watching again from it resumes the changes,
+// as long as they are retained.
+type OverflowError struct {
+	Seq uint64
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("watcher buffer full after change %d", e.Seq)
+}
+
+// ChangeKind is the kind of write reported by a Change
+type ChangeKind int
+
+const (
+	ChangePut         ChangeKind = iota // Key was set to Value
+	ChangeDelete                        // Key was deleted
+	ChangeMerge                         // Value was merged into Key
+	ChangeDeleteRange                   // the keys in [Key, End) were deleted
+)
+
+// Change is a write reported by Watch
+type Change struct {
+	Seq  uint64
+	Kind ChangeKind
+	Key  []byte
+	// Value is the value of a ChangePut, or the operand of a ChangeMerge
+	Value []byte
+	// Expiry is set for the values written with a TTL
+	Expiry time.Time
+	// End is the end of a ChangeDeleteRange, empty if it has no upper bound
+	End []byte
+}
+
+// changes returns the changes made by the write w, in new buffers
+func changes(seq uint64, w store.Write) ([]Change, error) {
+	if r, ok := w.RangeDelete(); ok {
+		return []Change{{Seq: seq, Kind: ChangeDeleteRange, Key: clone(r.Start), End: clone(r.End)}}, nil
+	}
+
+	if store.IsOperand(w.Value) {
+		operands, err := store.Operands(w.Value)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]Change, len(operands))
+		for i, op := range operands {
+			res[i] = Change{Seq: seq, Kind: ChangeMerge, Key: clone(w.Key), Value: clone(op)}
+		}
+		return res, nil
+	}
+
+	val, expiry, found := store.ParseValue(w.Value)
+	if !found {
+		return []Change{{Seq: seq, Kind: ChangeDelete, Key: clone(w.Key)}}, nil
+	}
+	return []Change{{Seq: seq, Kind: ChangePut, Key: clone(w.Key), Value: clone(val), Expiry: expiry}}, nil
+}
+
+// LastSeq returns the sequence number of the last write, watching from it
+// only reports the writes to come.
+func (db *DB) LastSeq() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.seq
+}
+
+// Watcher reports the changes of the keys starting with a prefix,
+// in the order they were written.
+type Watcher struct {
+	db     *DB
+	prefix []byte
+	from   uint64
+
+	// changes written before Watch, read from the WAL files
+	hmu      sync.Mutex
+	history  []*store.WALReader
+	until    uint64
+	buffered []Change
+
+	// changes written since Watch, pushed by the writers
+	mu       sync.Mutex
+	pending  []Change
+	overflow bool // the writers stopped pushing
+	notify   chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	change Change
+	err    error
+}
+
+// Watch returns a Watcher reporting the changes of the keys starting with
+// prefix, whose sequence number is greater than fromSeq. The changes
+// written before Watch are read from the WAL and the retained segments,
+// it fails with ErrChangesTruncated if some were already removed: a
+// consumer can resume after a restart from the last sequence number it
+// processed, as long as it is retained.
+//
+// Range deletions are reported when they cover the prefix or when their
+// start key has the prefix. Changes are buffered in memory until Next
+// returns them, up to the limit set by WithWatchBuffer. The Watcher must
+// be closed after use.
+func (db *DB) Watch(prefix []byte, fromSeq uint64) (*Watcher, error) {
+	w := &Watcher{
+		db:     db,
+		prefix: clone(prefix),
+		from:   fromSeq,
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := w.openHistory(); err != nil {
+		w.closeHistory()
+		return nil, err
+	}
+
+	db.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// openHistory opens the WAL files holding the changes from w.from to the
+// last write, db.mu must be held
+func (w *Watcher) openHistory() error {
+	db := w.db
+	w.until = db.seq
+	if w.from >= w.until {
+		return nil
+	}
+
+	bases, err := db.segments()
+	if err != nil {
+		return err
+	}
+	paths := make([]string, len(bases))
+	for i, base := range bases {
+		paths[i] = db.segmentPath(base)
+	}
+	bases = append(bases, db.walBase)
+	paths = append(paths, filepath.Join(db.dirname, walFilename))
+
+	if w.from < bases[0] {
+		return ErrChangesTruncated
+	}
+	for i, path := range paths {
+		// skip the files before from
+		if i+1 < len(bases) && bases[i+1] <= w.from {
+			continue
+		}
+		r, err := store.OpenWAL(path)
+		if os.IsNotExist(err) && i == len(paths)-1 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		w.history = append(w.history, r)
+	}
+	return nil
+}
+
+func (w *Watcher) closeHistory() {
+	for _, r := range w.history {
+		r.Close()
+	}
+	w.history, w.buffered = nil, nil
+}
+
+// matches returns true if c concerns the keys of the prefix
+func (w *Watcher) matches(c Change) bool {
+	if c.Kind == ChangeDeleteRange {
+		r := store.RangeTombstone{Start: c.Key, End: c.End}
+		if r.Covers(w.db.opts.cmp, w.prefix) {
+			return true
+		}
+	}
+	return bytes.HasPrefix(c.Key, w.prefix)
+}
+
+// notify reports the write w to the watchers, db.mu must be held
+func (db *DB) notify(seq uint64, w store.Write) {
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	changes, err := changes(seq, w)
+	if err != nil {
+		return
+	}
+	for watcher := range db.watchers {
+		if !watcher.push(changes) {
+			delete(db.watchers, watcher)
+		}
+	}
+}
+
+// push buffers the changes w watches, it returns false if they don't
+// fit in the buffer: w then stops after the changes already buffered.
+func (w *Watcher) push(changes []Change) bool {
+	var matching []Change
+	for _, c := range changes {
+		if c.Seq > w.from && w.matches(c) {
+			matching = append(matching, c)
+		}
+	}
+
+	w.mu.Lock()
+	if len(w.pending)+len(matching) > w.db.opts.watchBuffer {
+		w.overflow = true
+	} else {
+		w.pending = append(w.pending, matching...)
+	}
+	overflow := w.overflow
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return !overflow
+}
+
+// Next waits for the next change, it returns false once the Watcher or
+// the DB is closed, or if an error occurred, like an OverflowError.
+// Close can be called concurrently to stop it.
+func (w *Watcher) Next() bool {
+	if w.err != nil {
+		return false
+	}
+
+	c, ok, err := w.nextHistory()
+	if err != nil {
+		w.err = err
+		return false
+	}
+	if ok {
+		w.change = c
+		return true
+	}
+
+	for {
+		w.mu.Lock()
+		if len(w.pending) > 0 {
+			w.change = w.pending[0]
+			w.pending = w.pending[1:]
+			w.mu.Unlock()
+			return true
+		}
+		overflow := w.overflow
+		w.mu.Unlock()
+
+		if overflow {
+			seq := w.from
+			if w.change.Seq > seq {
+				seq = w.change.Seq
+			}
+			w.err = &OverflowError{Seq: seq}
+			return false
+		}
+
+		select {
+		case <-w.notify:
+		case <-w.closed:
+			return false
+		}
+	}
+}
+
+// nextHistory returns the next change written before Watch
+func (w *Watcher) nextHistory() (Change, bool, error) {
+	w.hmu.Lock()
+	defer w.hmu.Unlock()
+
+	for len(w.buffered) == 0 && len(w.history) > 0 {
+		select {
+		case <-w.closed:
+			return Change{}, false, nil
+		default:
+		}
+
+		// the current WAL is still written to,
+		// it must not be read past the last write seen by Watch
+		r := w.history[0]
+		if r.Seq() >= w.until {
+			w.closeHistory()
+			break
+		}
+
+		seq, write, err := r.Next()
+		if err == io.EOF {
+			r.Close()
+			w.history = w.history[1:]
+			continue
+		}
+		if err != nil {
+			return Change{}, false, err
+		}
+		if seq <= w.from {
+			continue
+		}
+
+		changes, err := changes(seq, write)
+		if err != nil {
+			return Change{}, false, err
+		}
+		for _, c := range changes {
+			if w.matches(c) {
+				w.buffered = append(w.buffered, c)
+			}
+		}
+	}
+
+	if len(w.buffered) == 0 {
+		return Change{}, false, nil
+	}
+	c := w.buffered[0]
+	w.buffered = w.buffered[1:]
+	return c, true, nil
+}
+
+// Change returns the change Next moved to, its slices are owned by the
+// caller.
+func (w *Watcher) Change() Change {
+	return w.change
+}
+
+// Err returns the error that stopped the Watcher, if any
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// stop makes Next return false
+func (w *Watcher) stop() {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+	})
+}
+
+// Close stops the Watcher and releases the files it reads
+func (w *Watcher) Close() error {
+	w.stop()
+
+	w.db.mu.Lock()
+	delete(w.db.watchers, w)
+	w.db.mu.Unlock()
+
+	w.hmu.Lock()
+	w.closeHistory()
+	w.hmu.Unlock()
+
+	w.mu.Lock()
+	w.pending = nil
+	w.mu.Unlock()
+	return nil
+}
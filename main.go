@@ -12,6 +12,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	defer store.Close()
 
 	store.Set("deleted", "wrong")
 
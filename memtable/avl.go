@@ -0,0 +1,51 @@
+package memtable
+
+import (
+	"github.com/jrouviere/minikv/avl"
+	"github.com/jrouviere/minikv/comparator"
+)
+
+type avlMemtable struct {
+	tree *avl.Tree
+}
+
+// NewAVL returns a memtable backed by an avl.Tree, its iterators
+// work on a snapshot of the tree.
+func NewAVL(cmp comparator.Comparator) Memtable {
+	return &avlMemtable{tree: avl.New(cmp)}
+}
+
+func (m *avlMemtable) Put(key, value []byte) {
+	m.tree.Upsert(key, value)
+}
+
+func (m *avlMemtable) PutSorted(keys, values [][]byte) {
+	i := 0
+	m.tree.UpsertSorted(func() (key, value []byte, ok bool) {
+		if i == len(keys) {
+			return nil, nil, false
+		}
+		i++
+		return keys[i-1], values[i-1], true
+	})
+}
+
+func (m *avlMemtable) Get(key []byte) ([]byte, bool) {
+	return m.tree.Get(key)
+}
+
+func (m *avlMemtable) Delete(key []byte) {
+	m.Put(key, nil)
+}
+
+func (m *avlMemtable) Iterator() Iterator {
+	return m.tree.Iterator()
+}
+
+func (m *avlMemtable) Snapshot() Reader {
+	return &avlMemtable{tree: m.tree.Snapshot()}
+}
+
+func (m *avlMemtable) ApproximateSize() int64 {
+	return m.tree.ApproximateSize()
+}
@@ -0,0 +1,52 @@
+/*
+Package memtable defines the in-memory sorted structure holding the most
+recent writes until they are flushed in an SSTable, and provides two
+implementations: a persistent AVL tree and a concurrent skiplist.
+
+Deleted keys are stored as an empty value, like in the SSTables, so that
+they shadow older values on disk.
+*/
+package memtable
+
+// Memtable implementations support concurrent readers and writers.
+// They keep references to the keys and values passed to Put, which
+// must not be modified afterwards, and the slices they return must
+// not be modified either.
+type Memtable interface {
+	Reader
+	Put(key, value []byte)
+	// PutSorted stores values[i] for keys[i] as if by calls to Put,
+	// the keys must be sorted and unique.
+	PutSorted(keys, values [][]byte)
+	// Delete stores a tombstone for key
+	Delete(key []byte)
+	// Snapshot returns a view of the memtable that later writes don't
+	// modify. Writes that haven't returned yet when Snapshot is called
+	// may or may not be part of it.
+	Snapshot() Reader
+	// ApproximateSize returns the memory used by keys, values and the
+	// nodes holding them, in bytes
+	ApproximateSize() int64
+}
+
+// Reader gives read access to a memtable or to one of its snapshots
+type Reader interface {
+	Get(key []byte) (value []byte, found bool)
+	// Iterator returns an unpositioned iterator, one of First, Last
+	// or Seek must be called before using it
+	Iterator() Iterator
+}
+
+// Iterator walks a memtable in key order
+type Iterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+
+	First()
+	Last()
+	// Seek moves to the smallest key greater or equal to key
+	Seek(key []byte)
+	Next()
+	Prev()
+}
@@ -0,0 +1,227 @@
+package memtable
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jrouviere/minikv/comparator"
+)
+
+var implementations = map[string]func(cmp comparator.Comparator) Memtable{
+	"avl":      NewAVL,
+	"skiplist": NewSkiplist,
+}
+
+func TestMemtable(t *testing.T) {
+	for name, newMemtable := range implementations {
+		t.Run(name, func(t *testing.T) {
+			mt := newMemtable(comparator.Bytewise)
+			all := make(map[string]string)
+
+			for i := 0; i < 1e4; i++ {
+				k := strconv.Itoa(rand.Intn(5000))
+				v := strconv.Itoa(i)
+				if i%10 == 0 {
+					mt.Delete([]byte(k))
+					v = ""
+				} else {
+					mt.Put([]byte(k), []byte(v))
+				}
+				all[k] = v
+			}
+
+			var keys []string
+			var size int64
+			for k, v := range all {
+				keys = append(keys, k)
+				size += int64(len(k) + len(v))
+
+				if val, found := mt.Get([]byte(k)); !found || string(val) != v {
+					t.Errorf("unexpected value for %v: %v != %v", k, val, v)
+				}
+			}
+			sort.Strings(keys)
+
+			if _, found := mt.Get([]byte("notfound")); found {
+				t.Errorf("unexpected key found")
+			}
+			// each key has some overhead on top of its key and value
+			if sz := mt.ApproximateSize(); sz < size || sz > size+int64(len(all))*512 {
+				t.Errorf("unexpected size: %v for %v bytes of data", sz, size)
+			}
+
+			checkIterator(t, mt.Iterator(), keys)
+		})
+	}
+}
+
+func TestMemtableConcurrent(t *testing.T) {
+	for name, newMemtable := range implementations {
+		t.Run(name, func(t *testing.T) {
+			mt := newMemtable(comparator.Bytewise)
+
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 1000; i++ {
+						mt.Put([]byte(strconv.Itoa(i)), []byte("value"))
+						mt.Put([]byte(strconv.Itoa(w)+"_"+strconv.Itoa(i)), []byte("value"))
+						mt.Get([]byte(strconv.Itoa(i / 2)))
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			var keys []string
+			for i := 0; i < 1000; i++ {
+				keys = append(keys, strconv.Itoa(i))
+				for w := 0; w < 4; w++ {
+					keys = append(keys, strconv.Itoa(w)+"_"+strconv.Itoa(i))
+				}
+			}
+			sort.Strings(keys)
+
+			checkIterator(t, mt.Iterator(), keys)
+		})
+	}
+}
+
+func TestMemtableSnapshot(t *testing.T) {
+	for name, newMemtable := range implementations {
+		t.Run(name, func(t *testing.T) {
+			mt := newMemtable(comparator.Bytewise)
+
+			var keys []string
+			for i := 0; i < 100; i += 2 {
+				k := strconv.Itoa(i)
+				mt.Put([]byte(k), []byte("v1"))
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			snap := mt.Snapshot()
+			for i := 0; i < 100; i++ {
+				mt.Put([]byte(strconv.Itoa(i)), []byte("v2"))
+			}
+
+			for _, k := range keys {
+				if val, found := snap.Get([]byte(k)); !found || string(val) != "v1" {
+					t.Errorf("unexpected value in snapshot for %v: %s", k, val)
+				}
+			}
+			if _, found := snap.Get([]byte("1")); found {
+				t.Errorf("key written after the snapshot is visible")
+			}
+			if val, _ := mt.Get([]byte("0")); string(val) != "v2" {
+				t.Errorf("unexpected value for 0: %s", val)
+			}
+
+			it := snap.Iterator()
+			for it.First(); it.Valid(); it.Next() {
+				if string(it.Value()) != "v1" {
+					t.Errorf("unexpected value in snapshot for %s: %s", it.Key(), it.Value())
+				}
+			}
+			checkIterator(t, it, keys)
+		})
+	}
+}
+
+func TestMemtablePutSorted(t *testing.T) {
+	for name, newMemtable := range implementations {
+		t.Run(name, func(t *testing.T) {
+			mt := newMemtable(comparator.Bytewise)
+
+			all := make(map[string]string)
+			for i := 0; i < 100; i += 2 {
+				k := strconv.Itoa(i)
+				mt.Put([]byte(k), []byte("old"))
+				all[k] = "old"
+			}
+
+			var keys, values [][]byte
+			for i := 0; i < 100; i += 3 {
+				keys = append(keys, []byte(strconv.Itoa(i)))
+			}
+			sort.Slice(keys, func(i, j int) bool { return string(keys[i]) < string(keys[j]) })
+			for _, k := range keys {
+				values = append(values, []byte("new"))
+				all[string(k)] = "new"
+			}
+			mt.PutSorted(keys, values)
+
+			var sorted []string
+			for k, v := range all {
+				sorted = append(sorted, k)
+				if val, found := mt.Get([]byte(k)); !found || string(val) != v {
+					t.Errorf("unexpected value for %v: %s != %v", k, val, v)
+				}
+			}
+			sort.Strings(sorted)
+			checkIterator(t, mt.Iterator(), sorted)
+		})
+	}
+}
+
+func BenchmarkParallelPut(b *testing.B) {
+	for name, newMemtable := range implementations {
+		b.Run(name, func(b *testing.B) {
+			mt := newMemtable(comparator.Bytewise)
+
+			var n int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&n, 1)
+					mt.Put([]byte("key_"+strconv.FormatInt(i, 10)), []byte("some test data"))
+				}
+			})
+		})
+	}
+}
+
+func checkIterator(t *testing.T, it Iterator, keys []string) {
+	t.Helper()
+
+	var i int
+	for it.First(); it.Valid(); it.Next() {
+		if i >= len(keys) || string(it.Key()) != keys[i] {
+			t.Fatalf("unexpected key at %v: %s", i, it.Key())
+		}
+		i++
+	}
+	if i != len(keys) {
+		t.Fatalf("iterated over %v keys, expected %v", i, len(keys))
+	}
+
+	i = len(keys) - 1
+	for it.Last(); it.Valid(); it.Prev() {
+		if i < 0 || string(it.Key()) != keys[i] {
+			t.Fatalf("unexpected key at %v: %s", i, it.Key())
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("reverse iteration stopped at %v", i)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(rand.Intn(10000))
+		exp := sort.SearchStrings(keys, key)
+
+		it.Seek([]byte(key))
+		if exp == len(keys) {
+			if it.Valid() {
+				t.Errorf("Seek(%v) should be past the end", key)
+			}
+		} else if !it.Valid() || string(it.Key()) != keys[exp] {
+			t.Errorf("Seek(%v) should be on %v", key, keys[exp])
+		}
+	}
+}
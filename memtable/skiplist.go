@@ -0,0 +1,296 @@
+package memtable
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/jrouviere/minikv/comparator"
+)
+
+const (
+	maxHeight = 12
+	// probability to go one level higher is 1/branching
+	branching = 4
+)
+
+// skiplist is a lock-free skiplist: nodes are linked with CAS and never
+// removed. Each node keeps all the values written for its key, newest
+// first, tagged with a sequence number so that snapshots can ignore the
+// versions written after them.
+type skiplist struct {
+	cmp  comparator.Comparator
+	head *slNode
+	size atomic.Int64
+	seq  atomic.Uint64
+}
+
+type slNode struct {
+	key      []byte
+	versions atomic.Pointer[slVersion]
+	next     []atomic.Pointer[slNode]
+}
+
+type slVersion struct {
+	value []byte
+	seq   uint64
+	prev  *slVersion
+}
+
+// memory used by a node besides its key, versions and links
+const nodeOverhead = int64(unsafe.Sizeof(slNode{}))
+
+// memory used by a version besides its value
+const versionOverhead = int64(unsafe.Sizeof(slVersion{}))
+
+const linkSize = int64(unsafe.Sizeof(atomic.Pointer[slNode]{}))
+
+// NewSkiplist returns a memtable backed by a concurrent skiplist,
+// writers don't block each other. Unlike the AVL tree, its iterators
+// see the updates made while they are in use, and overwritten values
+// are kept until the memtable is dropped.
+func NewSkiplist(cmp comparator.Comparator) Memtable {
+	if cmp == nil {
+		cmp = comparator.Bytewise
+	}
+	return &skiplist{
+		cmp:  cmp,
+		head: &slNode{next: make([]atomic.Pointer[slNode], maxHeight)},
+	}
+}
+
+func randomHeight() int {
+	h := 1
+	for h < maxHeight && rand.Intn(branching) == 0 {
+		h++
+	}
+	return h
+}
+
+// findGE returns the first node with a key greater or equal to key,
+// and fills preds and succs with the surrounding nodes at each level.
+func (s *skiplist) findGE(key []byte, preds, succs *[maxHeight]*slNode) *slNode {
+	x := s.head
+	for level := maxHeight - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && s.cmp.Compare(next.key, key) < 0 {
+			x = next
+			next = x.next[level].Load()
+		}
+		if preds != nil {
+			preds[level] = x
+			succs[level] = next
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+// findLT returns the last node with a key lower than key, or nil
+func (s *skiplist) findLT(key []byte) *slNode {
+	x := s.head
+	for level := maxHeight - 1; level >= 0; level-- {
+		next := x.next[level].Load()
+		for next != nil && s.cmp.Compare(next.key, key) < 0 {
+			x = next
+			next = x.next[level].Load()
+		}
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+func (s *skiplist) findLast() *slNode {
+	x := s.head
+	for level := maxHeight - 1; level >= 0; level-- {
+		for next := x.next[level].Load(); next != nil; next = x.next[level].Load() {
+			x = next
+		}
+	}
+	if x == s.head {
+		return nil
+	}
+	return x
+}
+
+// PutSorted inserts the keys one by one, each insertion being
+// concurrent with the other writers.
+func (s *skiplist) PutSorted(keys, values [][]byte) {
+	for i, key := range keys {
+		s.Put(key, values[i])
+	}
+}
+
+func (s *skiplist) Put(key, value []byte) {
+	var preds, succs [maxHeight]*slNode
+
+	for {
+		if n := s.findGE(key, &preds, &succs); n != nil && s.cmp.Compare(n.key, key) == 0 {
+			s.addVersion(n, value)
+			return
+		}
+
+		h := randomHeight()
+		n := &slNode{
+			key:  key,
+			next: make([]atomic.Pointer[slNode], h),
+		}
+		n.versions.Store(&slVersion{value: value, seq: s.seq.Add(1)})
+		for i := 0; i < h; i++ {
+			n.next[i].Store(succs[i])
+		}
+
+		// the node is part of the list once linked at level 0,
+		// if we lose the race the key may have been inserted: retry
+		if !preds[0].next[0].CompareAndSwap(succs[0], n) {
+			continue
+		}
+		s.size.Add(nodeOverhead + versionOverhead + int64(h)*linkSize + int64(len(key)+len(value)))
+
+		// upper levels are only shortcuts, link them on a best effort
+		for i := 1; i < h; i++ {
+			for !preds[i].next[i].CompareAndSwap(succs[i], n) {
+				s.findGE(key, &preds, &succs)
+				n.next[i].Store(succs[i])
+			}
+		}
+		return
+	}
+}
+
+// addVersion pushes a new value on top of the versions of n, the
+// sequence number is taken in the CAS loop to keep versions ordered
+func (s *skiplist) addVersion(n *slNode, value []byte) {
+	for {
+		prev := n.versions.Load()
+		v := &slVersion{value: value, seq: s.seq.Add(1), prev: prev}
+		if n.versions.CompareAndSwap(prev, v) {
+			s.size.Add(versionOverhead + int64(len(value)))
+			return
+		}
+	}
+}
+
+// versionAt returns the newest version of n written at or before seq,
+// or nil if n didn't exist then
+func (n *slNode) versionAt(seq uint64) *slVersion {
+	v := n.versions.Load()
+	for v != nil && v.seq > seq {
+		v = v.prev
+	}
+	return v
+}
+
+func (s *skiplist) Get(key []byte) ([]byte, bool) {
+	return s.getAt(key, math.MaxUint64)
+}
+
+func (s *skiplist) getAt(key []byte, seq uint64) ([]byte, bool) {
+	n := s.findGE(key, nil, nil)
+	if n == nil || s.cmp.Compare(n.key, key) != 0 {
+		return nil, false
+	}
+	if v := n.versionAt(seq); v != nil {
+		return v.value, true
+	}
+	return nil, false
+}
+
+func (s *skiplist) Delete(key []byte) {
+	s.Put(key, nil)
+}
+
+func (s *skiplist) Iterator() Iterator {
+	return &slIterator{list: s, seq: math.MaxUint64}
+}
+
+func (s *skiplist) Snapshot() Reader {
+	return &slSnapshot{list: s, seq: s.seq.Load()}
+}
+
+type slSnapshot struct {
+	list *skiplist
+	seq  uint64
+}
+
+func (s *slSnapshot) Get(key []byte) ([]byte, bool) {
+	return s.list.getAt(key, s.seq)
+}
+
+func (s *slSnapshot) Iterator() Iterator {
+	return &slIterator{list: s.list, seq: s.seq}
+}
+
+func (s *skiplist) ApproximateSize() int64 {
+	return s.size.Load()
+}
+
+// slIterator only stops on the nodes having a version visible at seq
+type slIterator struct {
+	list    *skiplist
+	seq     uint64
+	node    *slNode
+	version *slVersion
+}
+
+func (it *slIterator) Valid() bool {
+	return it.node != nil
+}
+
+func (it *slIterator) Key() []byte {
+	return it.node.key
+}
+
+func (it *slIterator) Value() []byte {
+	return it.version.value
+}
+
+func (it *slIterator) First() {
+	it.node = it.list.head.next[0].Load()
+	it.skipForward()
+}
+
+func (it *slIterator) Last() {
+	it.node = it.list.findLast()
+	it.skipBackward()
+}
+
+func (it *slIterator) Seek(key []byte) {
+	it.node = it.list.findGE(key, nil, nil)
+	it.skipForward()
+}
+
+func (it *slIterator) Next() {
+	if it.node != nil {
+		it.node = it.node.next[0].Load()
+		it.skipForward()
+	}
+}
+
+func (it *slIterator) Prev() {
+	if it.node != nil {
+		it.node = it.list.findLT(it.node.key)
+		it.skipBackward()
+	}
+}
+
+func (it *slIterator) skipForward() {
+	for ; it.node != nil; it.node = it.node.next[0].Load() {
+		if it.version = it.node.versionAt(it.seq); it.version != nil {
+			return
+		}
+	}
+}
+
+func (it *slIterator) skipBackward() {
+	for ; it.node != nil; it.node = it.list.findLT(it.node.key) {
+		if it.version = it.node.versionAt(it.seq); it.version != nil {
+			return
+		}
+	}
+}
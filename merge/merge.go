@@ -0,0 +1,108 @@
+// Package merge defines merge operators, which combine values with
+// operands written by DB.Merge without reading them first.
+package merge
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Operator combines the operands written for a key with its value.
+// Operands are stored as they are written and only combined when the
+// key is read or when tables are compacted, so an operator must always
+// be registered for a database containing operands.
+type Operator interface {
+	// FullMerge applies operands, oldest first, to the existing value,
+	// which is nil if the key doesn't exist or was deleted.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+
+	// PartialMerge combines two consecutive operands into a single one,
+	// ok is false if they can't be combined without the existing value.
+	PartialMerge(key, older, newer []byte) (operand []byte, ok bool)
+}
+
+// Int64Add adds integers stored as decimal strings, a missing
+// value counts as 0.
+var Int64Add Operator = int64Add{}
+
+type int64Add struct{}
+
+func (int64Add) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		v, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sum = v
+	}
+	for _, op := range operands {
+		v, err := strconv.ParseInt(string(op), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sum += v
+	}
+	return strconv.AppendInt(nil, sum, 10), nil
+}
+
+func (int64Add) PartialMerge(_, older, newer []byte) ([]byte, bool) {
+	a, err := strconv.ParseInt(string(older), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	b, err := strconv.ParseInt(string(newer), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return strconv.AppendInt(nil, a+b, 10), true
+}
+
+// StringAppend returns an operator appending the operands to the
+// value, separated by sep.
+func StringAppend(sep string) Operator {
+	return stringAppend{sep: []byte(sep)}
+}
+
+type stringAppend struct {
+	sep []byte
+}
+
+func (s stringAppend) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	res := append([]byte{}, existing...)
+	for i, op := range operands {
+		if existing != nil || i > 0 {
+			res = append(res, s.sep...)
+		}
+		res = append(res, op...)
+	}
+	return res, nil
+}
+
+func (s stringAppend) PartialMerge(_, older, newer []byte) ([]byte, bool) {
+	res := append([]byte{}, older...)
+	res = append(res, s.sep...)
+	return append(res, newer...), true
+}
+
+// Max keeps the bytewise largest of the value and the operands.
+var Max Operator = maxOperator{}
+
+type maxOperator struct{}
+
+func (maxOperator) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	res := existing
+	for _, op := range operands {
+		if res == nil || bytes.Compare(op, res) > 0 {
+			res = op
+		}
+	}
+	return append([]byte{}, res...), nil
+}
+
+func (maxOperator) PartialMerge(_, older, newer []byte) ([]byte, bool) {
+	if bytes.Compare(newer, older) > 0 {
+		return newer, true
+	}
+	return older, true
+}
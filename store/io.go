@@ -3,7 +3,6 @@ package store
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"io"
 )
 
@@ -27,20 +26,31 @@ func (rd *fileReader) ReadUint64() (uint64, error) {
 	return v, err
 }
 
-func (rd *fileReader) ReadString() (string, error) {
+// ReadBytes reads a length prefixed byte slice in a new buffer
+func (rd *fileReader) ReadBytes() ([]byte, error) {
+	return rd.ReadBytesInto(nil)
+}
+
+// ReadBytesInto reads a length prefixed byte slice,
+// reusing buf when it is large enough
+func (rd *fileReader) ReadBytesInto(buf []byte) ([]byte, error) {
 	var v uint64
 	if err := binary.Read(rd.r, binary.LittleEndian, &v); err != nil {
-		return "", err
+		return nil, err
 	}
 	rd.offset += 8
 
-	buf := make([]byte, v)
+	if uint64(cap(buf)) < v {
+		buf = make([]byte, v)
+	}
+	buf = buf[:v]
+
 	n, err := io.ReadFull(rd.r, buf)
 	rd.offset += int64(n)
 	if uint64(n) < v {
-		return "", fmt.Errorf("short read")
+		return nil, io.ErrUnexpectedEOF
 	}
-	return string(buf), err
+	return buf, err
 }
 
 func (rd *fileReader) Offset() int64 {
@@ -70,12 +80,12 @@ func (ow *fileWriter) WriteUint64(v uint64) error {
 	return binary.Write(ow.w, binary.LittleEndian, v)
 }
 
-func (ow *fileWriter) WriteString(s string) error {
-	if err := binary.Write(ow.w, binary.LittleEndian, uint64(len(s))); err != nil {
+func (ow *fileWriter) WriteBytes(b []byte) error {
+	if err := binary.Write(ow.w, binary.LittleEndian, uint64(len(b))); err != nil {
 		return err
 	}
 
-	if _, err := ow.w.WriteString(s); err != nil {
+	if _, err := ow.w.Write(b); err != nil {
 		return err
 	}
 
@@ -0,0 +1,43 @@
+package store
+
+import "github.com/jrouviere/minikv/comparator"
+
+// RangeTombstone deletes all the keys in [Start, End), an empty End means
+// no upper bound. It only deletes the keys written before it: the point
+// entries stored along with it, in the same memtable or sstable, are
+// always newer and shadow it.
+type RangeTombstone struct {
+	Start, End []byte
+}
+
+// Covers returns true if key is in the range of r
+func (r RangeTombstone) Covers(cmp comparator.Comparator, key []byte) bool {
+	if cmp.Compare(key, r.Start) < 0 {
+		return false
+	}
+	return len(r.End) == 0 || cmp.Compare(key, r.End) < 0
+}
+
+// Covered returns true if one of the tombstones covers key
+func Covered(cmp comparator.Comparator, tombstones []RangeTombstone, key []byte) bool {
+	for _, r := range tombstones {
+		if r.Covers(cmp, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRangeDelete returns the WAL write storing r, see Write.RangeDelete
+func NewRangeDelete(r RangeTombstone) Write {
+	return Write{Key: r.Start, Value: append([]byte{kindRangeDelete}, r.End...)}
+}
+
+// RangeDelete returns the range tombstone stored by w, ok is false if
+// w is a point write.
+func (w Write) RangeDelete() (r RangeTombstone, ok bool) {
+	if len(w.Value) == 0 || w.Value[0] != kindRangeDelete {
+		return RangeTombstone{}, false
+	}
+	return RangeTombstone{Start: w.Key, End: w.Value[1:]}, true
+}
@@ -1,89 +1,156 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/jrouviere/minikv/avl"
+	"github.com/jrouviere/minikv/comparator"
+	"github.com/jrouviere/minikv/merge"
 )
 
-const magic = 0x7473732d696e696d
+const (
+	// legacy tables, without header, always in bytewise order
+	magicV1 = 0x7473732d696e696d
+	magic   = 0x3273732d696e696d
+)
 
 const sparcity = 16
 
 /*
-SSTable is an immutable file storing a list of sorted string.
-Deleted keys are stored as en empty string.
+SSTable is an immutable file storing a list of sorted keys and values.
+Deleted keys are stored with an empty value, other values start with
+their kind, see NewValue.
 
 File format:
 
 magic: uint64
+[comparator name]
+seq: uint64
+range tombstones count: uint64
+M times {[start] [end]}
 N times {[key] -> [value]}
 
-key and value are both string stored as:
+comparator name, range tombstones, key and value are all byte slices stored as:
 len: uint64
-len times char: byte
+len times byte
+
+seq is the sequence number of the last write of the WAL that the table
+contains.
+
+Legacy tables have a different magic and no header, they can only be
+read with comparator.Bytewise, and their values have no kind byte.
 */
 type SSTable struct {
-	filename string
-	index    []keyOff // in-memory sparse index
+	filename  string
+	cmp       comparator.Comparator
+	untagged  bool     // values without kind byte
+	dataStart int64    // offset of the first key
+	index     []keyOff // in-memory sparse index
+	memUsage  int64
+
+	rangeDels []RangeTombstone
+	seq       uint64
+
+	mu      sync.Mutex
+	refs    int
+	deleted bool
 }
 
 type keyOff struct {
-	key    string
+	key    []byte
 	offset int64
 }
 
-func WriteFile(filename string, memtable *avl.Tree) error {
+var keyOffSize = int64(unsafe.Sizeof(keyOff{}))
+
+// ErrComparatorMismatch is returned when opening a table
+// with a different comparator than the one it was written with.
+var ErrComparatorMismatch = errors.New("sstable comparator mismatch")
+
+// Iterator is the sorted input of WriteFile
+type Iterator interface {
+	First()
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() []byte
+}
+
+// WriteFile writes all the keys of it, ordered by cmp, and the range
+// tombstones in a new SSTable containing the writes up to seq
+func WriteFile(filename string, cmp comparator.Comparator, it Iterator, seq uint64, rangeDels []RangeTombstone) error {
 	sst, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer sst.Close()
 	sstWr := newWriter(sst)
-	defer sstWr.Flush()
 
 	if err := sstWr.WriteUint64(magic); err != nil {
 		return err
 	}
+	if err := sstWr.WriteBytes([]byte(cmp.Name())); err != nil {
+		return err
+	}
+	if err := sstWr.WriteUint64(seq); err != nil {
+		return err
+	}
+	if err := sstWr.WriteUint64(uint64(len(rangeDels))); err != nil {
+		return err
+	}
+	for _, r := range rangeDels {
+		if err := sstWr.WriteBytes(r.Start); err != nil {
+			return err
+		}
+		if err := sstWr.WriteBytes(r.End); err != nil {
+			return err
+		}
+	}
 
-	var wrErr error
-	memtable.InorderTraversal(func(n *avl.Node) {
-		if err := sstWr.WriteString(n.Key); err != nil {
-			wrErr = err
+	for it.First(); it.Valid(); it.Next() {
+		if err := sstWr.WriteBytes(it.Key()); err != nil {
+			return err
 		}
-		if err := sstWr.WriteString(n.Value); err != nil {
-			wrErr = err
+		if err := sstWr.WriteBytes(it.Value()); err != nil {
+			return err
 		}
-	})
-	return wrErr
+	}
+	return sstWr.Flush()
 }
 
-func LoadSST(filename string) (*SSTable, error) {
+// LoadSST opens a table and builds its index, it fails with
+// ErrComparatorMismatch if the table is not ordered by cmp.
+func LoadSST(filename string, cmp comparator.Comparator) (*SSTable, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	sstRd := newReader(file)
-	m1, err := sstRd.ReadUint64()
+	sstRd, hdr, err := processHeader(file, cmp)
 	if err != nil {
-		return nil, err
-	}
-
-	if m1 != magic {
-		return nil, fmt.Errorf("unexpected magic: %v", m1)
+		return nil, fmt.Errorf("%s: %w", filename, err)
 	}
+	dataStart := sstRd.Offset()
 
 	var index []keyOff
+	var memUsage int64
+	for _, r := range hdr.rangeDels {
+		memUsage += int64(len(r.Start) + len(r.End))
+	}
+	var key, value []byte
 	for i := uint64(0); ; i++ {
 		offset := sstRd.Offset()
 
-		key, err := sstRd.ReadString()
+		key, err = sstRd.ReadBytesInto(key)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -91,163 +158,537 @@ func LoadSST(filename string) (*SSTable, error) {
 			return nil, err
 		}
 
-		_, err = sstRd.ReadString()
+		value, err = sstRd.ReadBytesInto(value)
 		if err != nil {
 			return nil, err
 		}
 
 		if i%sparcity == 0 {
 			index = append(index, keyOff{
-				key:    key,
+				key:    clone(key),
 				offset: offset,
 			})
+			memUsage += keyOffSize + int64(len(key))
 		}
 	}
 
 	return &SSTable{
-		filename: filename,
-		index:    index,
+		filename:  filename,
+		cmp:       cmp,
+		untagged:  hdr.untagged,
+		dataStart: dataStart,
+		index:     index,
+		memUsage:  memUsage,
+		rangeDels: hdr.rangeDels,
+		seq:       hdr.seq,
 	}, nil
 }
 
-func (sst *SSTable) Get(key string) (val string, found bool, err error) {
-	file, err := os.Open(sst.filename)
+// Get returns the value stored for key, in a new buffer
+func (sst *SSTable) Get(key []byte) (val []byte, found bool, err error) {
+	it, err := sst.NewIterator()
 	if err != nil {
-		return "", false, err
+		return nil, false, err
 	}
-	defer file.Close()
-	sstRd := newReader(file)
-
-	// binary search in our sparse index
-	// to find the interval where our key should be in the file
-	next := sort.Search(len(sst.index), func(i int) bool {
-		return key < sst.index[i].key
-	})
+	defer it.Close()
 
-	if next == 0 {
-		return "", false, nil // not found
+	it.Seek(key)
+	if !it.Valid() || sst.cmp.Compare(it.Key(), key) != 0 {
+		return nil, false, it.Err()
 	}
-	next--
+	return clone(it.Value()), true, nil
+}
 
-	start := sst.index[next].offset
-	if err := sstRd.SeekTo(start); err != nil {
-		return "", false, err
+// GetSorted looks for keys, which must be sorted by the comparator of the
+// table, in a single pass over the table file. f is called for each key
+// found with its index in keys, value is only valid during the call.
+// GetSorted stops at the first error returned by f.
+func (sst *SSTable) GetSorted(keys [][]byte, f func(i int, value []byte) error) error {
+	it, err := sst.NewIterator()
+	if err != nil {
+		return err
 	}
+	defer it.Close()
 
-	for {
-		rdKey, err := sstRd.ReadString()
-		if err == io.EOF {
-			return "", false, nil // not found
+	for i, key := range keys {
+		it.seekForward(key)
+		if !it.Valid() {
+			break
 		}
-		if err != nil {
-			return "", false, err
+		if sst.cmp.Compare(it.Key(), key) == 0 {
+			if err := f(i, it.Value()); err != nil {
+				return err
+			}
 		}
+	}
+	return it.Err()
+}
 
-		rdValue, err := sstRd.ReadString()
-		if err != nil {
-			return "", false, err
-		}
-		if key == rdKey {
-			return rdValue, true, nil // found it!
-		}
-		if key < rdKey {
-			return "", false, nil // not found
-		}
+func (sst *SSTable) Filename() string {
+	return sst.filename
+}
+
+// MemoryUsage returns the memory used by the in-memory index, in bytes
+func (sst *SSTable) MemoryUsage() int64 {
+	return sst.memUsage
+}
+
+// RangeTombstones returns the range tombstones of the table,
+// the slice must not be modified.
+func (sst *SSTable) RangeTombstones() []RangeTombstone {
+	return sst.rangeDels
+}
+
+// Seq returns the sequence number of the last write of the WAL
+// contained in the table, 0 if unknown
+func (sst *SSTable) Seq() uint64 {
+	return sst.seq
+}
+
+// Empty returns true if the table doesn't contain any key
+// nor range tombstone
+func (sst *SSTable) Empty() bool {
+	return len(sst.index) == 0 && len(sst.rangeDels) == 0
+}
+
+// Ref pins the table file on disk, a call to Delete
+// will be deferred until the matching Unref.
+func (sst *SSTable) Ref() {
+	sst.mu.Lock()
+	defer sst.mu.Unlock()
+
+	sst.refs++
+}
+
+func (sst *SSTable) Unref() error {
+	sst.mu.Lock()
+	defer sst.mu.Unlock()
+
+	sst.refs--
+	if sst.refs == 0 && sst.deleted {
+		return os.Remove(sst.filename)
 	}
+	return nil
 }
 
+// Delete removes the table file, or marks it to be removed
+// once it is no longer referenced.
 func (sst *SSTable) Delete() error {
+	sst.mu.Lock()
+	defer sst.mu.Unlock()
+
+	sst.deleted = true
+	if sst.refs > 0 {
+		return nil
+	}
 	return os.Remove(sst.filename)
 }
 
-// Merge two sstables together
-// sst2 is more recent than sst1
-// ie: sst2 overrides key from sst1
-func Merge(sst1, sst2 *SSTable, destination string) error {
-	f1, err := os.Open(sst1.filename)
+// TableIterator reads the keys of an SSTable in order. The slices
+// returned by Key and Value are only valid until the next call to
+// Seek, First or Next, and must not be modified.
+type TableIterator struct {
+	sst    *SSTable
+	file   *os.File
+	rd     *fileReader
+	key    []byte
+	value  []byte
+	raw    []byte // value read from untagged tables
+	offset int64  // offset of the current key
+	valid  bool
+	err    error
+}
+
+// NewIterator opens the table file, the iterator must be closed
+// after use. It is unpositioned until First or Seek is called.
+func (sst *SSTable) NewIterator() (*TableIterator, error) {
+	file, err := os.Open(sst.filename)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return &TableIterator{
+		sst:  sst,
+		file: file,
+		rd:   newReader(file),
+	}, nil
+}
+
+func (it *TableIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *TableIterator) Key() []byte {
+	return it.key
+}
+
+func (it *TableIterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that invalidated the iterator, if any
+func (it *TableIterator) Err() error {
+	return it.err
+}
+
+func (it *TableIterator) Close() error {
+	return it.file.Close()
+}
+
+// First moves to the first key of the table
+func (it *TableIterator) First() {
+	it.seekTo(it.sst.dataStart)
+}
+
+// Seek moves to the smallest key greater or equal to key
+func (it *TableIterator) Seek(key []byte) {
+	block := it.block(key)
+	if block < 0 {
+		it.First()
+		return
+	}
+	it.seekTo(it.sst.index[block].offset)
+	it.skipTo(key)
+}
+
+// seekForward is like Seek, for a key greater or equal to the current
+// one: when key is in the current block of the sparse index, it reads on
+// from the current position instead of seeking in the file.
+func (it *TableIterator) seekForward(key []byte) {
+	block := it.block(key)
+	if !it.valid || block < 0 || it.offset < it.sst.index[block].offset {
+		it.Seek(key)
+		return
+	}
+	it.skipTo(key)
+}
+
+// block does a binary search in our sparse index to find the interval
+// where key should be in the file, it returns -1 if key is before the
+// first interval.
+func (it *TableIterator) block(key []byte) int {
+	cmp := it.sst.cmp
+	index := it.sst.index
+	next := sort.Search(len(index), func(i int) bool {
+		return cmp.Compare(key, index[i].key) < 0
+	})
+	return next - 1
+}
+
+// skipTo moves forward to the smallest key greater or equal to key
+func (it *TableIterator) skipTo(key []byte) {
+	for it.valid && it.sst.cmp.Compare(it.key, key) < 0 {
+		it.Next()
+	}
+}
+
+func (it *TableIterator) seekTo(offset int64) {
+	if it.err = it.rd.SeekTo(offset); it.err != nil {
+		it.valid = false
+		return
+	}
+	it.valid = true
+	it.Next()
+}
+
+// Next moves to the next key
+func (it *TableIterator) Next() {
+	if !it.valid {
+		return
 	}
-	defer f1.Close()
 
-	f2, err := os.Open(sst2.filename)
+	var err error
+	it.offset = it.rd.Offset()
+	it.key, err = it.rd.ReadBytesInto(it.key)
+	if err == nil && it.sst.untagged {
+		it.raw, err = it.rd.ReadBytesInto(it.raw)
+		it.value = tagLegacy(it.value, it.raw)
+	} else if err == nil {
+		it.value, err = it.rd.ReadBytesInto(it.value)
+	}
 	if err != nil {
-		return err
+		it.valid = false
+		if err != io.EOF {
+			it.err = err
+		}
 	}
-	defer f2.Close()
+}
 
-	rd1, err := processHeader(f1)
+// FilterDecision is what a CompactionFilter decides for a value
+type FilterDecision int
+
+const (
+	FilterKeep FilterDecision = iota
+	FilterRemove
+	FilterChange
+)
+
+// CompactionFilter lets applications drop or rewrite values during
+// compactions. Deletions and merge operands are not filtered.
+type CompactionFilter interface {
+	// Filter is called for each value written by a compaction, newValue
+	// replaces value when FilterChange is returned, keeping its expiry.
+	// value must not be modified or retained.
+	Filter(key, value []byte) (decision FilterDecision, newValue []byte)
+}
+
+// CompactionStats counts the records of compactions
+type CompactionStats struct {
+	Compactions int
+	Read        int // records read from the input tables
+	Written     int // records written in the output table
+	Expired     int // expired values removed
+	Kept        int // values kept by the filter
+	Removed     int // values removed by the filter
+	Changed     int // values changed by the filter
+	Covered     int // records removed by a range tombstone
+}
+
+// Add accumulates the counts of other in s
+func (s *CompactionStats) Add(other CompactionStats) {
+	s.Compactions += other.Compactions
+	s.Read += other.Read
+	s.Written += other.Written
+	s.Expired += other.Expired
+	s.Kept += other.Kept
+	s.Removed += other.Removed
+	s.Changed += other.Changed
+	s.Covered += other.Covered
+}
+
+// MergeOptions configures Merge
+type MergeOptions struct {
+	// Operator combines the merge operands of the tables
+	Operator merge.Operator
+	// Bottom is set when no table older than the merged ones exists,
+	// merge operands are then applied and stored as values, expired
+	// values are dropped instead of being replaced by a deletion, and
+	// range tombstones are dropped.
+	Bottom bool
+	// Now is the time at which values expire, nothing expires if zero
+	Now time.Time
+	// Filter is called for each value, if set. Removed values are
+	// dropped, or replaced by a deletion when Bottom is not set.
+	Filter CompactionFilter
+}
+
+// Merge two sstables together
+// sst2 is more recent than sst1
+// ie: sst2 overrides key from sst1
+// and the range tombstones of sst2 remove keys from sst1
+// both tables must use the same comparator
+func Merge(sst1, sst2 *SSTable, destination string, opts MergeOptions) (CompactionStats, error) {
+	stats := CompactionStats{Compactions: 1}
+
+	cmp := sst2.cmp
+	if cmp.Name() != sst1.cmp.Name() {
+		return stats, ErrComparatorMismatch
+	}
+
+	it1, err := sst1.NewIterator()
 	if err != nil {
-		return err
+		return stats, err
 	}
-	rd2, err := processHeader(f2)
+	defer it1.Close()
+
+	it2, err := sst2.NewIterator()
 	if err != nil {
-		return err
+		return stats, err
 	}
+	defer it2.Close()
+
+	it1.First()
+	it2.First()
 
 	// we use a memtable to simplify things
 	// but really the result should be written
 	// in a sst file directly
-	var memtable avl.Tree
+	var mergeErr error
+	memtable := avl.FromSorted(cmp, func() (key, value []byte, ok bool) {
+		for {
+			var c int
+			switch {
+			case mergeErr != nil:
+				return nil, nil, false
+			case !it1.Valid() && !it2.Valid():
+				return nil, nil, false
+			case !it1.Valid():
+				c = 1
+			case !it2.Valid():
+				c = -1
+			default:
+				c = cmp.Compare(it1.Key(), it2.Key())
+			}
 
-	key1, value1 := nextKey(rd1)
-	key2, value2 := nextKey(rd2)
+			if c < 0 && Covered(cmp, sst2.rangeDels, it1.Key()) {
+				it1.Next()
+				stats.Read++
+				stats.Covered++
+				continue
+			}
 
-	for key1 != "" || key2 != "" {
-		switch {
-		case key1 == key2:
-			memtable.Upsert(key2, value2)
-			key1, value1 = nextKey(rd1)
-			key2, value2 = nextKey(rd2)
+			// the iterators reuse their buffers
+			if c < 0 {
+				key, value = clone(it1.Key()), clone(it1.Value())
+			} else {
+				key, value = clone(it2.Key()), clone(it2.Value())
+			}
 
-		case key1 == "" || key2 < key1:
-			memtable.Upsert(key2, value2)
-			key2, value2 = nextKey(rd2)
+			// operands of sst2 stack on the value of sst1
+			// unless a range tombstone of sst2 deleted it
+			if c == 0 && IsOperand(value) {
+				older := it1.Value()
+				if Covered(cmp, sst2.rangeDels, key) {
+					older = nil
+				}
+				value, mergeErr = Stack(opts.Operator, key, value, older)
+			}
+			if opts.Bottom && IsOperand(value) {
+				value, mergeErr = Stack(opts.Operator, key, value, nil)
+			}
+			if mergeErr == nil && isPending(value) && !opts.Now.IsZero() {
+				value, mergeErr = settle(opts.Operator, key, value, opts.Now)
+			}
 
-		case key2 == "" || key1 < key2:
-			memtable.Upsert(key1, value1)
-			key1, value1 = nextKey(rd1)
+			if c <= 0 {
+				it1.Next()
+				stats.Read++
+			}
+			if c >= 0 {
+				it2.Next()
+				stats.Read++
+			}
 
-		default:
-			panic("should not happen")
+			remove := false
+			if !opts.Now.IsZero() && Expired(value, opts.Now) {
+				stats.Expired++
+				remove = true
+			} else if opts.Filter != nil && len(value) > 0 && !IsOperand(value) && !isPending(value) {
+				val, _, _ := parseValue(value, time.Time{})
+				switch decision, newValue := opts.Filter.Filter(key, val); decision {
+				case FilterRemove:
+					stats.Removed++
+					remove = true
+				case FilterChange:
+					stats.Changed++
+					value = newValueLike(newValue, value)
+				default:
+					stats.Kept++
+				}
+			}
+
+			if remove {
+				if opts.Bottom {
+					continue
+				}
+				value = nil
+			}
+			stats.Written++
+			return key, value, true
 		}
+	})
+
+	if mergeErr != nil {
+		return stats, mergeErr
+	}
+	if it1.Err() != nil {
+		return stats, it1.Err()
+	}
+	if it2.Err() != nil {
+		return stats, it2.Err()
+	}
+
+	// the range tombstones still apply to the older tables
+	var rangeDels []RangeTombstone
+	if !opts.Bottom {
+		rangeDels = append(rangeDels, sst1.rangeDels...)
+		rangeDels = append(rangeDels, sst2.rangeDels...)
+	}
+
+	seq := sst1.seq
+	if sst2.seq > seq {
+		seq = sst2.seq
 	}
 
-	return WriteFile(destination, &memtable)
+	return stats, WriteFile(destination, cmp, memtable.Iterator(), seq, rangeDels)
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+type header struct {
+	untagged  bool // legacy values without kind byte
+	seq       uint64
+	rangeDels []RangeTombstone
 }
 
-func processHeader(file *os.File) (*fileReader, error) {
-	rd := newReader(file)
+// processHeader checks the header of a table, and leaves
+// the reader at the first key
+func processHeader(file *os.File, cmp comparator.Comparator) (rd *fileReader, hdr header, err error) {
+	rd = newReader(file)
 
 	m1, err := rd.ReadUint64()
 	if err != nil {
-		return nil, err
+		return nil, hdr, err
+	}
+
+	var name string
+	switch m1 {
+	case magicV1:
+		name = comparator.Bytewise.Name()
+		hdr.untagged = true
+	case magic:
+		b, err := rd.ReadBytes()
+		if err != nil {
+			return nil, hdr, err
+		}
+		name = string(b)
+	default:
+		return nil, hdr, fmt.Errorf("unexpected magic: %v", m1)
 	}
 
-	if m1 != magic {
-		return nil, fmt.Errorf("unexpected magic: %v", m1)
+	if name != cmp.Name() {
+		return nil, hdr, fmt.Errorf("%w: written with %q, opened with %q", ErrComparatorMismatch, name, cmp.Name())
 	}
 
-	return rd, nil
+	if m1 == magic {
+		if hdr.seq, err = rd.ReadUint64(); err != nil {
+			return nil, hdr, err
+		}
+		if hdr.rangeDels, err = readRangeTombstones(rd); err != nil {
+			return nil, hdr, err
+		}
+	}
+
+	return rd, hdr, nil
 }
 
-func nextKey(rd *fileReader) (string, string) {
-	key, err := rd.ReadString()
+func readRangeTombstones(rd *fileReader) ([]RangeTombstone, error) {
+	count, err := rd.ReadUint64()
 	if err != nil {
-		return "", ""
+		return nil, err
 	}
-	val, err := rd.ReadString()
-	if err != nil {
-		return "", ""
+
+	var rangeDels []RangeTombstone
+	for i := uint64(0); i < count; i++ {
+		var r RangeTombstone
+		if r.Start, err = rd.ReadBytes(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if r.End, err = rd.ReadBytes(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		rangeDels = append(rangeDels, r)
 	}
-	return key, val
+	return rangeDels, nil
 }
 
 func (sst *SSTable) Debug() string {
 	var sb strings.Builder
 	fmt.Fprintf(&sb, "SST: %v\n", sst.filename)
 	for _, idx := range sst.index {
-		fmt.Fprintf(&sb, "0x%04X: %v\n", idx.offset, idx.key)
+		fmt.Fprintf(&sb, "0x%04X: %s\n", idx.offset, idx.key)
 	}
 	return sb.String()
 }
@@ -0,0 +1,316 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jrouviere/minikv/merge"
+)
+
+/*
+Values are stored in the memtable, the WAL and the sstables with a
+leading kind byte, so that merge operands can be told apart from values.
+Deletions are still stored as an empty value.
+
+	value:   kindValue, value bytes
+	expiring value: kindExpiring, expiry: uint64 big-endian unix nanoseconds, value bytes
+	operand: kindMerge, N times {len: uvarint, operand bytes}, oldest first
+	pending operands: kindPending, len: uvarint, value, operands as above
+
+Expired values are treated as deletions. Pending operands are stacked
+on top of the value they were written on when the result depends on the
+time it is read: once the value expired, they apply to a deleted key.
+
+The WAL also stores range tombstones as a write of their start key, see
+NewRangeDelete:
+
+	range deletion: kindRangeDelete, end bytes
+
+Files written before merge operands existed only contain values without
+kind byte, they are tagged when read.
+*/
+const (
+	kindValue    = 1
+	kindMerge    = 2
+	kindExpiring = 3
+	kindPending  = 5
+
+	kindRangeDelete = 4
+)
+
+// ErrNoMergeOperator is returned when reading merge operands
+// without merge operator.
+var ErrNoMergeOperator = errors.New("merge operands found without merge operator")
+
+var errBadOperands = errors.New("corrupted merge operands")
+
+// MergeError is returned when the merge operator fails to apply the
+// operands of a key, which are kept as they are.
+type MergeError struct {
+	Key []byte
+	Err error
+}
+
+func (e *MergeError) Error() string {
+	return fmt.Sprintf("merge operands of %q: %v", e.Key, e.Err)
+}
+
+func (e *MergeError) Unwrap() error {
+	return e.Err
+}
+
+// NewValue returns the stored form of a value,
+// an empty value is a deletion.
+func NewValue(v []byte) []byte {
+	if len(v) == 0 {
+		return nil
+	}
+	return append([]byte{kindValue}, v...)
+}
+
+// NewExpiringValue returns the stored form of a value
+// which is deleted at expiry.
+func NewExpiringValue(v []byte, expiry time.Time) []byte {
+	if len(v) == 0 {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint64([]byte{kindExpiring}, uint64(expiry.UnixNano()))
+	return append(b, v...)
+}
+
+// parseValue returns the value stored in v, found is false if v is a
+// deletion or expired at now. v must not be merge operands.
+func parseValue(v []byte, now time.Time) (val []byte, expiry time.Time, found bool) {
+	switch {
+	case len(v) == 0:
+		return nil, time.Time{}, false
+	case v[0] == kindExpiring && len(v) <= 9:
+		return nil, time.Time{}, false
+	case v[0] == kindExpiring:
+		expiry = time.Unix(0, int64(binary.BigEndian.Uint64(v[1:9])))
+		if !now.Before(expiry) {
+			return nil, time.Time{}, false
+		}
+		return v[9:], expiry, true
+	default:
+		return v[1:], time.Time{}, true
+	}
+}
+
+// newValueLike returns the stored form of v with the expiry of old
+func newValueLike(v []byte, old []byte) []byte {
+	if _, expiry, _ := parseValue(old, time.Time{}); !expiry.IsZero() {
+		return NewExpiringValue(v, expiry)
+	}
+	return NewValue(v)
+}
+
+// ParseValue returns the value stored in v and its expiry, zero if it
+// never expires, found is false if v is a deletion. v must not be merge
+// operands.
+func ParseValue(v []byte) (val []byte, expiry time.Time, found bool) {
+	return parseValue(v, time.Time{})
+}
+
+// Expired returns true if v is a value expired at now
+func Expired(v []byte, now time.Time) bool {
+	if len(v) == 0 || v[0] != kindExpiring {
+		return false
+	}
+	_, _, found := parseValue(v, now)
+	return !found
+}
+
+// NewOperand returns the stored form of a merge operand
+func NewOperand(operand []byte) []byte {
+	return appendOperands([]byte{kindMerge}, [][]byte{operand})
+}
+
+// IsOperand returns true if the stored value v is made of merge operands,
+// that still have to be applied to an older value.
+func IsOperand(v []byte) bool {
+	return len(v) > 0 && v[0] == kindMerge
+}
+
+// isPending returns true if v is made of pending operands
+func isPending(v []byte) bool {
+	return len(v) > 0 && v[0] == kindPending
+}
+
+func newPending(base []byte, operands [][]byte) []byte {
+	b := binary.AppendUvarint([]byte{kindPending}, uint64(len(base)))
+	return appendOperands(append(b, base...), operands)
+}
+
+// parsePending returns the value and the operands of the pending
+// operands v
+func parsePending(v []byte) (base []byte, operands [][]byte, err error) {
+	n, sz := binary.Uvarint(v[1:])
+	if sz <= 0 || uint64(len(v)-1-sz) < n {
+		return nil, nil, errBadOperands
+	}
+	b := v[1+sz:]
+	operands, err = parseOperands(b[n:])
+	return b[:n], operands, err
+}
+
+// tagLegacy converts a value of a legacy file into its stored form,
+// reusing buf when it is large enough.
+func tagLegacy(buf, v []byte) []byte {
+	if len(v) == 0 {
+		return v
+	}
+	return append(append(buf[:0], kindValue), v...)
+}
+
+func appendOperands(dst []byte, operands [][]byte) []byte {
+	for _, op := range operands {
+		dst = binary.AppendUvarint(dst, uint64(len(op)))
+		dst = append(dst, op...)
+	}
+	return dst
+}
+
+// Operands returns the merge operands stored in v, oldest first
+func Operands(v []byte) ([][]byte, error) {
+	return parseOperands(v[1:])
+}
+
+func parseOperands(b []byte) ([][]byte, error) {
+	var res [][]byte
+	for len(b) > 0 {
+		n, sz := binary.Uvarint(b)
+		if sz <= 0 || uint64(len(b)-sz) < n {
+			return nil, errBadOperands
+		}
+		res = append(res, b[sz:sz+int(n)])
+		b = b[sz+int(n):]
+	}
+	return res, nil
+}
+
+// Combine stacks the merge operands newer on top of the older stored
+// value of key, older is empty if the key was deleted. Operands on top
+// of a value or a deletion are applied, the result is then a value which
+// keeps the expiry of older: the operands expire along with it. A value
+// expired at now is a deletion. Operands on top of operands or pending
+// operands are stacked on them.
+func Combine(op merge.Operator, key, newer, older []byte, now time.Time) ([]byte, error) {
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	ops, err := Operands(newer)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case IsOperand(older):
+		olderOps, err := Operands(older)
+		if err != nil {
+			return nil, err
+		}
+		return appendOperands([]byte{kindMerge}, stack(op, key, append(olderOps, ops...))), nil
+	case isPending(older):
+		base, olderOps, err := parsePending(older)
+		if err != nil {
+			return nil, err
+		}
+		return newPending(base, stack(op, key, append(olderOps, ops...))), nil
+	}
+
+	existing, expiry, _ := parseValue(older, now)
+	v, err := op.FullMerge(key, existing, ops)
+	if err != nil {
+		return nil, &MergeError{Key: clone(key), Err: err}
+	}
+	if !expiry.IsZero() {
+		return NewExpiringValue(v, expiry), nil
+	}
+	return NewValue(v), nil
+}
+
+// Stack is Combine for a result that must not depend on the time, like
+// the memtable entries, computed again when the WAL is replayed, or the
+// tables written by compactions: operands on top of an expiring value
+// are kept as pending operands. So are the operands which the operator
+// fails to apply, the error is returned when they are read.
+func Stack(op merge.Operator, key, newer, older []byte) ([]byte, error) {
+	if len(older) == 0 || older[0] != kindExpiring {
+		v, err := Combine(op, key, newer, older, time.Time{})
+		var merr *MergeError
+		if !errors.As(err, &merr) {
+			return v, err
+		}
+	}
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+	ops, err := Operands(newer)
+	if err != nil {
+		return nil, err
+	}
+	return newPending(older, stack(op, key, ops)), nil
+}
+
+// stack combines consecutive operands when possible
+func stack(op merge.Operator, key []byte, ops [][]byte) [][]byte {
+	stacked := ops[:1]
+	for _, o := range ops[1:] {
+		last := len(stacked) - 1
+		if p, ok := op.PartialMerge(key, stacked[last], o); ok {
+			stacked[last] = p
+		} else {
+			stacked = append(stacked, o)
+		}
+	}
+	return stacked
+}
+
+// apply applies the merge operands or the pending operands v at now,
+// it returns other values unchanged.
+func apply(op merge.Operator, key, v []byte, now time.Time) ([]byte, error) {
+	switch {
+	case IsOperand(v):
+		return Combine(op, key, v, nil, now)
+	case isPending(v):
+		base, ops, err := parsePending(v)
+		if err != nil {
+			return nil, err
+		}
+		return Combine(op, key, appendOperands([]byte{kindMerge}, ops), base, now)
+	}
+	return v, nil
+}
+
+// settle applies the pending operands v once their value expired at now,
+// the result then no longer depends on the time. They are kept if the
+// operator fails to apply them.
+func settle(op merge.Operator, key, v []byte, now time.Time) ([]byte, error) {
+	base, _, err := parsePending(v)
+	if err != nil {
+		return nil, err
+	}
+	if !Expired(base, now) {
+		return v, nil
+	}
+	res, err := apply(op, key, v, now)
+	var merr *MergeError
+	if errors.As(err, &merr) {
+		return v, nil
+	}
+	return res, err
+}
+
+// Resolve returns the value of key at now given its newest stored value
+// v, merge operands are applied as if the key didn't exist before them.
+// The value returned may share memory with v.
+func Resolve(op merge.Operator, key, v []byte, now time.Time) (val []byte, found bool, err error) {
+	if v, err = apply(op, key, v, now); err != nil {
+		return nil, false, err
+	}
+	val, _, found = parseValue(v, now)
+	return val, found, nil
+}
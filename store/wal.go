@@ -1,38 +1,166 @@
 package store
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
 	"os"
-
-	"github.com/jrouviere/minikv/avl"
 )
 
-func LoadWAL(filename string) (*avl.Tree, error) {
-	f, err := os.Open(filename)
+// WAL file format: the magic number and the sequence number of the last
+// write before the WAL, then one record per commit made of the number of
+// writes, the key/value pairs and a crc32 of the record, so that a commit
+// is replayed entirely or not at all. Each write has the next sequence
+// number. Range tombstones are stored as writes, see NewRangeDelete.
+//
+// The legacy format has no magic number and no records, only pairs, and
+// its values have no kind byte.
+const walMagic = 0x6c61772d696e696d
+
+var errChecksum = errors.New("wal: checksum mismatch")
+
+// Write is a single update in a WAL record, values are in their stored
+// form, see NewValue.
+type Write struct {
+	Key, Value []byte
+}
+
+// WALReader reads the writes of a WAL in order
+type WALReader struct {
+	file  *os.File
+	rd    *fileReader
+	magic uint64 // 0 for the legacy format
+	seq   uint64
+	batch []Write
+}
+
+// OpenWAL opens a WAL for reading, the file can still be appended to
+// by a WAL.
+func OpenWAL(filename string) (*WALReader, error) {
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	r := &WALReader{file: file, rd: newReader(file)}
 
-	rd := newReader(f)
+	magic, err := r.rd.ReadUint64()
+	switch {
+	case err == io.EOF:
+		return r, nil
+	case err != nil && err != io.ErrUnexpectedEOF:
+		file.Close()
+		return nil, err
+	case err == nil && magic == walMagic:
+		r.magic = magic
+		r.seq, err = r.rd.ReadUint64()
+	default:
+		err = r.rd.SeekTo(0)
+	}
+	// a truncated header is an empty WAL
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
 
-	var memtable avl.Tree
+// Seq returns the sequence number of the last write read,
+// or of the last write before the WAL.
+func (r *WALReader) Seq() uint64 {
+	return r.seq
+}
 
-	for {
-		key, err := rd.ReadString()
-		if err != nil {
-			if err == io.EOF {
-				break
+// Next returns the next write and its sequence number, the write is owned
+// by the caller. It returns io.EOF at the end of the WAL, an incomplete
+// last record, left by a crash during a commit, is ignored.
+func (r *WALReader) Next() (seq uint64, w Write, err error) {
+	for len(r.batch) == 0 {
+		if r.batch, err = r.readRecord(); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
 			}
-			return nil, err
+			return 0, Write{}, err
+		}
+	}
+
+	w, r.batch = r.batch[0], r.batch[1:]
+	if r.magic == 0 {
+		w.Value = tagLegacy(nil, w.Value)
+	}
+	r.seq++
+	return r.seq, w, nil
+}
+
+func (r *WALReader) readRecord() ([]Write, error) {
+	if r.magic != 0 {
+		return readRecord(r.rd)
+	}
+
+	// the legacy format has a single write per pair
+	var w Write
+	var err error
+	if w.Key, err = r.rd.ReadBytes(); err != nil {
+		return nil, err
+	}
+	if w.Value, err = r.rd.ReadBytes(); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return []Write{w}, nil
+}
+
+func (r *WALReader) Close() error {
+	return r.file.Close()
+}
+
+// readRecord returns io.EOF at the end of the file and
+// io.ErrUnexpectedEOF if the record is truncated
+func readRecord(rd *fileReader) ([]Write, error) {
+	count, err := rd.ReadUint64()
+	if err != nil {
+		return nil, err
+	}
+	crc := crcUint64(0, count)
+
+	var batch []Write
+	for i := uint64(0); i < count; i++ {
+		var w Write
+		if w.Key, err = rd.ReadBytes(); err != nil {
+			return nil, unexpectedEOF(err)
 		}
-		val, err := rd.ReadString()
-		if err != nil {
-			return nil, err
+		if w.Value, err = rd.ReadBytes(); err != nil {
+			return nil, unexpectedEOF(err)
 		}
-		memtable.Upsert(key, val)
+		crc = crcBytes(crcBytes(crc, w.Key), w.Value)
+		batch = append(batch, w)
+	}
+
+	sum, err := rd.ReadUint64()
+	if err != nil {
+		return nil, unexpectedEOF(err)
 	}
+	if uint32(sum) != crc {
+		return nil, errChecksum
+	}
+	return batch, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func crcUint64(crc uint32, v uint64) uint32 {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return crc32.Update(crc, crc32.IEEETable, b[:])
+}
 
-	return &memtable, nil
+// crcBytes adds a length prefixed byte slice to crc
+func crcBytes(crc uint32, b []byte) uint32 {
+	return crc32.Update(crcUint64(crc, uint64(len(b))), crc32.IEEETable, b)
 }
 
 type WAL struct {
@@ -40,33 +168,58 @@ type WAL struct {
 	wr   *fileWriter
 }
 
-func NewWAL(filename string) (*WAL, error) {
+// NewWAL creates a WAL whose first write follows the sequence number seq
+func NewWAL(filename string, seq uint64) (*WAL, error) {
 	f, err := os.Create(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WAL{
+	w := &WAL{
 		file: f,
 		wr:   newWriter(f),
-	}, nil
+	}
+	if err := w.writeHeader(seq); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
 }
 
-func (w *WAL) Commit(key, value string) error {
-	if err := w.wr.WriteString(key); err != nil {
+func (w *WAL) writeHeader(seq uint64) error {
+	if err := w.wr.WriteUint64(walMagic); err != nil {
 		return err
 	}
-	if err := w.wr.WriteString(value); err != nil {
+	if err := w.wr.WriteUint64(seq); err != nil {
 		return err
 	}
 	return w.wr.Flush()
 }
 
-func (w *WAL) Reset() error {
-	if err := w.file.Truncate(0); err != nil {
+// CommitBatch writes all the updates of batch in a single record
+func (w *WAL) CommitBatch(batch []Write) error {
+	count := uint64(len(batch))
+	if err := w.wr.WriteUint64(count); err != nil {
 		return err
 	}
+	crc := crcUint64(0, count)
 
-	_, err := w.file.Seek(0, io.SeekStart)
-	return err
+	for _, b := range batch {
+		if err := w.wr.WriteBytes(b.Key); err != nil {
+			return err
+		}
+		if err := w.wr.WriteBytes(b.Value); err != nil {
+			return err
+		}
+		crc = crcBytes(crcBytes(crc, b.Key), b.Value)
+	}
+
+	if err := w.wr.WriteUint64(uint64(crc)); err != nil {
+		return err
+	}
+	return w.wr.Flush()
+}
+
+func (w *WAL) Close() error {
+	return w.file.Close()
 }
@@ -0,0 +1,280 @@
+/*
+Package tuple encodes tuples of values into byte strings whose bytewise
+order matches the order of the tuples, so that they can be used as
+composite keys, e.g. (tenant, timestamp, id).
+
+Tuples are compared element by element, a tuple sorts before any longer
+tuple it is a prefix of. Elements of different types are ordered by
+type: nil, []byte, string, integers, floats, false, true. Signed and
+unsigned integers are one type and compare by value.
+
+The encoding follows the FoundationDB tuple layer:
+
+	nil           0x00
+	[]byte        0x01 bytes 0x00, with 0x00 escaped as 0x00 0xFF
+	string        0x02 utf-8 0x00, escaped like []byte
+	integers      0x14±n followed by the n bytes of the absolute value,
+	              one's complement for negative numbers
+	float32/64    0x21 big-endian IEEE 754 with the sign bit flipped,
+	              and all bits flipped for negative numbers
+	false, true   0x26, 0x27
+*/
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	nilCode    = 0x00
+	bytesCode  = 0x01
+	stringCode = 0x02
+	intZero    = 0x14
+	floatCode  = 0x21
+	falseCode  = 0x26
+	trueCode   = 0x27
+
+	escape = 0xFF
+)
+
+// Tuple elements can be nil, []byte, string, bool, float32, float64
+// and any signed or unsigned integer type.
+type Tuple []interface{}
+
+// ErrInvalid is returned by Unpack on malformed input
+var ErrInvalid = errors.New("tuple: invalid encoding")
+
+// Pack encodes the tuple, it panics on unsupported element types.
+func (t Tuple) Pack() []byte {
+	return t.AppendPacked(nil)
+}
+
+// AppendPacked appends the encoded tuple to dst and returns the result
+func (t Tuple) AppendPacked(dst []byte) []byte {
+	for i, e := range t {
+		switch v := e.(type) {
+		case nil:
+			dst = append(dst, nilCode)
+		case []byte:
+			dst = appendBytes(append(dst, bytesCode), v)
+		case string:
+			dst = appendBytes(append(dst, stringCode), []byte(v))
+		case bool:
+			if v {
+				dst = append(dst, trueCode)
+			} else {
+				dst = append(dst, falseCode)
+			}
+		case float32:
+			dst = appendFloat(dst, float64(v))
+		case float64:
+			dst = appendFloat(dst, v)
+		case int:
+			dst = appendInt(dst, int64(v))
+		case int8:
+			dst = appendInt(dst, int64(v))
+		case int16:
+			dst = appendInt(dst, int64(v))
+		case int32:
+			dst = appendInt(dst, int64(v))
+		case int64:
+			dst = appendInt(dst, v)
+		case uint:
+			dst = appendUint(dst, uint64(v))
+		case uint8:
+			dst = appendUint(dst, uint64(v))
+		case uint16:
+			dst = appendUint(dst, uint64(v))
+		case uint32:
+			dst = appendUint(dst, uint64(v))
+		case uint64:
+			dst = appendUint(dst, v)
+		default:
+			panic(fmt.Sprintf("tuple: unsupported type %T for element %d", e, i))
+		}
+	}
+	return dst
+}
+
+func appendBytes(dst, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, c)
+		if c == 0x00 {
+			dst = append(dst, escape)
+		}
+	}
+	return append(dst, 0x00)
+}
+
+func appendUint(dst []byte, v uint64) []byte {
+	n := byteLen(v)
+	dst = append(dst, byte(intZero+n))
+	return appendBigEndian(dst, v, n)
+}
+
+func appendInt(dst []byte, v int64) []byte {
+	if v >= 0 {
+		return appendUint(dst, uint64(v))
+	}
+
+	// magnitude of v, correct for math.MinInt64 too
+	abs := uint64(-(v + 1)) + 1
+	n := byteLen(abs)
+	dst = append(dst, byte(intZero-n))
+	return appendBigEndian(dst, ^abs, n)
+}
+
+// byteLen returns the number of bytes needed to store v
+func byteLen(v uint64) int {
+	n := 0
+	for v > 0 {
+		n++
+		v >>= 8
+	}
+	return n
+}
+
+func appendBigEndian(dst []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		dst = append(dst, byte(v>>(8*i)))
+	}
+	return dst
+}
+
+func appendFloat(dst []byte, f float64) []byte {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	dst = append(dst, floatCode)
+	return binary.BigEndian.AppendUint64(dst, bits)
+}
+
+// Unpack decodes a packed tuple. Integers are decoded as int64, or
+// uint64 when they don't fit, floats as float64 and strings and byte
+// slices are copied.
+func Unpack(b []byte) (Tuple, error) {
+	var t Tuple
+	for len(b) > 0 {
+		code := b[0]
+		b = b[1:]
+
+		switch {
+		case code == nilCode:
+			t = append(t, nil)
+
+		case code == bytesCode || code == stringCode:
+			v, rest, err := decodeBytes(b)
+			if err != nil {
+				return nil, err
+			}
+			b = rest
+			if code == bytesCode {
+				t = append(t, v)
+			} else {
+				t = append(t, string(v))
+			}
+
+		case code >= intZero-8 && code <= intZero+8:
+			n := int(code) - intZero
+			neg := n < 0
+			if neg {
+				n = -n
+			}
+			if len(b) < n {
+				return nil, ErrInvalid
+			}
+			var v uint64
+			for _, c := range b[:n] {
+				v = v<<8 | uint64(c)
+			}
+			b = b[n:]
+
+			switch {
+			case !neg && v > math.MaxInt64:
+				t = append(t, v)
+			case !neg:
+				t = append(t, int64(v))
+			default:
+				// v is the one's complement of the magnitude on n bytes
+				abs := ^v
+				if n < 8 {
+					abs &= 1<<(8*n) - 1
+				}
+				t = append(t, -int64(abs-1)-1)
+			}
+
+		case code == floatCode:
+			if len(b) < 8 {
+				return nil, ErrInvalid
+			}
+			bits := binary.BigEndian.Uint64(b)
+			b = b[8:]
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			t = append(t, math.Float64frombits(bits))
+
+		case code == falseCode:
+			t = append(t, false)
+
+		case code == trueCode:
+			t = append(t, true)
+
+		default:
+			return nil, fmt.Errorf("%w: unknown type code 0x%02x", ErrInvalid, code)
+		}
+	}
+	return t, nil
+}
+
+func decodeBytes(b []byte) (v, rest []byte, err error) {
+	v = []byte{}
+	for i := 0; i < len(b); i++ {
+		if b[i] != 0x00 {
+			v = append(v, b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == escape {
+			v = append(v, 0x00)
+			i++
+			continue
+		}
+		return v, b[i+1:], nil
+	}
+	return nil, nil, fmt.Errorf("%w: unterminated string", ErrInvalid)
+}
+
+// Range returns the [start, end) interval containing the keys of all
+// the tuples strictly longer than t and starting with its elements,
+// suitable for the DB range scans.
+func (t Tuple) Range() (start, end []byte) {
+	p := t.Pack()
+	start = append(p[:len(p):len(p)], 0x00)
+	end = append(p[:len(p):len(p)], 0xFF)
+	return start, end
+}
+
+// PrefixRange returns the [start, end) interval containing all the keys
+// starting with prefix. end is nil, ie. unbounded, when prefix is empty
+// or only made of 0xFF bytes.
+func PrefixRange(prefix []byte) (start, end []byte) {
+	start = append([]byte{}, prefix...)
+
+	end = append([]byte{}, prefix...)
+	for len(end) > 0 {
+		if end[len(end)-1] != 0xFF {
+			end[len(end)-1]++
+			return start, end
+		}
+		end = end[:len(end)-1]
+	}
+	return start, nil
+}
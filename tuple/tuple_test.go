@@ -0,0 +1,286 @@
+package tuple
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jrouviere/minikv/db"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tuples := []Tuple{
+		{},
+		{nil},
+		{[]byte{}, []byte{0x00, 0xFF, 0x00}, ""},
+		{"tenant", "a\x00b", int64(0)},
+		{int64(1), int64(-1), int64(255), int64(-255), int64(256), int64(-256)},
+		{int64(math.MaxInt64), int64(math.MinInt64), uint64(math.MaxUint64)},
+		{0.0, -1.5, math.Inf(1), math.Inf(-1), math.SmallestNonzeroFloat64},
+		{true, false, nil, "x"},
+	}
+
+	for _, tup := range tuples {
+		got, err := Unpack(tup.Pack())
+		if err != nil {
+			t.Fatalf("Unpack(%v): %v", tup, err)
+		}
+		if len(tup) == 0 && len(got) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tup) {
+			t.Errorf("Unpack(Pack(%v)) = %v", tup, got)
+		}
+	}
+}
+
+func TestNativeTypes(t *testing.T) {
+	tup := Tuple{int8(-3), int16(300), int32(-70000), 42, uint8(7), uint16(1), uint32(2), uint(3), float32(0.5)}
+	want := Tuple{int64(-3), int64(300), int64(-70000), int64(42), int64(7), int64(1), int64(2), int64(3), 0.5}
+
+	got, err := Unpack(tup.Pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUnpackInvalid(t *testing.T) {
+	for _, b := range [][]byte{
+		{stringCode, 'a'},
+		{intZero + 2, 0x01},
+		{floatCode, 0x00},
+		{0x50},
+	} {
+		if _, err := Unpack(b); err == nil {
+			t.Errorf("Unpack(%x) should fail", b)
+		}
+	}
+}
+
+// rank orders elements by type like the encoding does
+func rank(e interface{}) int {
+	switch e.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return 1
+	case string:
+		return 2
+	case int64, uint64:
+		return 3
+	case float64:
+		return 4
+	case bool:
+		if e.(bool) {
+			return 6
+		}
+		return 5
+	}
+	panic("unexpected type")
+}
+
+func compareElem(a, b interface{}) int {
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case int64:
+		if b, ok := b.(uint64); ok {
+			if a < 0 {
+				return -1
+			}
+			return compareUint(uint64(a), b)
+		}
+		b64 := b.(int64)
+		switch {
+		case a < b64:
+			return -1
+		case a > b64:
+			return 1
+		}
+		return 0
+	case uint64:
+		if b, ok := b.(int64); ok {
+			if b < 0 {
+				return 1
+			}
+			return compareUint(a, uint64(b))
+		}
+		return compareUint(a, b.(uint64))
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTuples(a, b Tuple) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareElem(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func randomElem(r *rand.Rand) interface{} {
+	switch r.Intn(7) {
+	case 0:
+		return nil
+	case 1:
+		b := make([]byte, r.Intn(3))
+		for i := range b {
+			b[i] = []byte{0x00, 0x01, 0xFF}[r.Intn(3)]
+		}
+		return b
+	case 2:
+		return string([]byte{"a\x00b"[r.Intn(3)], "a\x00b"[r.Intn(3)]})[:r.Intn(3)]
+	case 3:
+		return r.Int63n(1<<20) - 1<<19
+	case 4:
+		return int64(r.Uint64()) // covers the whole int64 range
+	case 5:
+		return r.NormFloat64() * 1000
+	default:
+		return r.Intn(2) == 0
+	}
+}
+
+func TestOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	tuples := make([]Tuple, 2000)
+	for i := range tuples {
+		tup := make(Tuple, r.Intn(4))
+		for j := range tup {
+			tup[j] = randomElem(r)
+		}
+		tuples[i] = tup
+	}
+	tuples = append(tuples, Tuple{uint64(math.MaxUint64)}, Tuple{uint64(math.MaxInt64 + 1)})
+
+	sort.Slice(tuples, func(i, j int) bool {
+		return bytes.Compare(tuples[i].Pack(), tuples[j].Pack()) < 0
+	})
+
+	for i := 1; i < len(tuples); i++ {
+		if compareTuples(tuples[i-1], tuples[i]) > 0 {
+			t.Fatalf("%v packed before %v", tuples[i-1], tuples[i])
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	prefix := Tuple{"tenant", int64(42)}
+	start, end := prefix.Range()
+
+	inside := []Tuple{
+		{"tenant", int64(42), nil},
+		{"tenant", int64(42), int64(-1)},
+		{"tenant", int64(42), "id", true},
+		{"tenant", int64(42), true},
+	}
+	outside := []Tuple{
+		{"tenant", int64(42)},
+		{"tenant", int64(41), "id"},
+		{"tenant", int64(43)},
+		{"tenant", int64(420)},
+		{"tenant2", int64(42), "id"},
+	}
+
+	for _, tup := range inside {
+		if k := tup.Pack(); bytes.Compare(k, start) < 0 || bytes.Compare(k, end) >= 0 {
+			t.Errorf("%v should be in range", tup)
+		}
+	}
+	for _, tup := range outside {
+		if k := tup.Pack(); bytes.Compare(k, start) >= 0 && bytes.Compare(k, end) < 0 {
+			t.Errorf("%v should not be in range", tup)
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix     []byte
+		start, end []byte
+	}{
+		{[]byte("ab"), []byte("ab"), []byte("ac")},
+		{[]byte{0x01, 0xFF}, []byte{0x01, 0xFF}, []byte{0x02}},
+		{[]byte{0xFF, 0xFF}, []byte{0xFF, 0xFF}, nil},
+		{nil, []byte{}, nil},
+	}
+
+	for _, tt := range tests {
+		start, end := PrefixRange(tt.prefix)
+		if !bytes.Equal(start, tt.start) || !bytes.Equal(end, tt.end) || (tt.end == nil) != (end == nil) {
+			t.Errorf("PrefixRange(%x) = %x, %x, want %x, %x", tt.prefix, start, end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestDBScan(t *testing.T) {
+	d, err := db.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, ts := range []int64{-5, 3, 1000, 20} {
+		for _, tenant := range []string{"acme", "acme2", "ac"} {
+			if err := d.Put(Tuple{tenant, ts, "id"}.Pack(), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	it, err := d.NewIterator(Tuple{"acme"}.Range())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var got []int64
+	for it.Next() {
+		tup, err := Unpack(it.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tup[0] != "acme" {
+			t.Fatalf("unexpected key %v", tup)
+		}
+		got = append(got, tup[1].(int64))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{-5, 3, 20, 1000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got timestamps %v, want %v", got, want)
+	}
+}